@@ -1,18 +1,21 @@
 package sqlitebackup
 
 import (
-	"compress/gzip"
 	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"filippo.io/age"
 	"github.com/caasmo/restinpieces/db"
+	"github.com/google/uuid"
 	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
 )
 
 const (
@@ -23,17 +26,239 @@ const (
 
 // Config defines the settings for the backup job.
 type Config struct {
-	SourcePath    string   `toml:"source_path"`
-	BackupDir     string   `toml:"backup_dir"`
-	Strategy      string   `toml:"strategy"`
-	PagesPerStep  int      `toml:"pages_per_step"`
-	SleepInterval Duration `toml:"sleep_interval"`
+	SourcePath    string   `toml:"source_path" json:"source_path" yaml:"source_path"`
+	BackupDir     string   `toml:"backup_dir" json:"backup_dir" yaml:"backup_dir"`
+	Strategy      string   `toml:"strategy" json:"strategy" yaml:"strategy"`
+	PagesPerStep  int      `toml:"pages_per_step" json:"pages_per_step" yaml:"pages_per_step"`
+	SleepInterval Duration `toml:"sleep_interval" json:"sleep_interval" yaml:"sleep_interval"`
+
+	// FilenameTimezone is the IANA time zone, e.g. Europe/Berlin, of the
+	// timestamp in backup filenames. Defaults to UTC.
+	FilenameTimezone string `toml:"filename_timezone" json:"filename_timezone" yaml:"filename_timezone"`
+
+	// FilenameScheme is FilenameSchemeTimestamp, the default, or
+	// FilenameSchemeReverse for names sorting newest first. The time zone
+	// does not apply to reverse timestamps.
+	FilenameScheme string `toml:"filename_scheme" json:"filename_scheme" yaml:"filename_scheme"`
+
+	// MirrorDirs receive a copy of every backup written to BackupDir,
+	// e.g. on other disks. A failing mirror does not fail the job.
+	MirrorDirs []string `toml:"mirror_dirs" json:"mirror_dirs" yaml:"mirror_dirs"`
+
+	// Compression selects the codec of the backup file, gzip, gzip-store,
+	// zstd or none.
+	// CompressionLevel is codec specific, 0 selects the codec default.
+	Compression      string `toml:"compression" json:"compression" yaml:"compression"`
+	CompressionLevel int    `toml:"compression_level" json:"compression_level" yaml:"compression_level"`
+	// AdaptiveCompression lowers the zstd level when compression is
+	// projected to run past the job deadline.
+	AdaptiveCompression bool `toml:"adaptive_compression" json:"adaptive_compression" yaml:"adaptive_compression"`
+	// CompressionBufferSize is the size in bytes of the single buffer the
+	// backup is copied through while compressing, see
+	// DefaultCompressionBufferSize.
+	CompressionBufferSize int `toml:"compression_buffer_size" json:"compression_buffer_size" yaml:"compression_buffer_size"`
+	// MinCompressionSavings is the fraction of space, e.g. 0.05, the
+	// compression must save. Backups saving less are stored uncompressed.
+	MinCompressionSavings float64 `toml:"min_compression_savings" json:"min_compression_savings" yaml:"min_compression_savings"`
+
+	// MaxRestarts is how often the online copy may restart because a
+	// writer modified the source, 0 for no limit. FallbackStrategy, if
+	// set to vacuum, is used instead of failing once the limit is hit.
+	MaxRestarts      int    `toml:"max_restarts" json:"max_restarts" yaml:"max_restarts"`
+	FallbackStrategy string `toml:"fallback_strategy" json:"fallback_strategy" yaml:"fallback_strategy"`
+
+	// VerifyAfterBackup verifies every backup in-process before the job
+	// succeeds, see Handler.verifyWritten.
+	VerifyAfterBackup bool `toml:"verify_after_backup" json:"verify_after_backup" yaml:"verify_after_backup"`
+
+	// VerifyReadWrite opens the copy verified by VerifyAfterBackup
+	// read-write, the way a restored database is opened.
+	VerifyReadWrite bool `toml:"verify_read_write" json:"verify_read_write" yaml:"verify_read_write"`
+
+	// VerifyPageSampleRate, if set, replaces the integrity check of
+	// VerifyAfterBackup with a spot check reading this fraction of the
+	// pages, see VerifyOptions.PageSampleRate.
+	VerifyPageSampleRate float64 `toml:"verify_page_sample_rate" json:"verify_page_sample_rate" yaml:"verify_page_sample_rate"`
+
+	// ExpectedApplicationID, if not 0, is the PRAGMA application_id the
+	// verification requires, so a misconfigured source path does not go
+	// unnoticed.
+	ExpectedApplicationID int32 `toml:"expected_application_id" json:"expected_application_id" yaml:"expected_application_id"`
+
+	// MaxCaptureAge, if set, is how old the captured source state may be
+	// when the copy completes. An older capture is logged as a warning, or
+	// fails the job with FailOnStaleCapture.
+	MaxCaptureAge      Duration `toml:"max_capture_age" json:"max_capture_age" yaml:"max_capture_age"`
+	FailOnStaleCapture bool     `toml:"fail_on_stale_capture" json:"fail_on_stale_capture" yaml:"fail_on_stale_capture"`
+
+	// SnapshotIsolation holds a read transaction on the source for the
+	// whole online copy, so the backup is a single consistent snapshot.
+	SnapshotIsolation bool `toml:"snapshot_isolation" json:"snapshot_isolation" yaml:"snapshot_isolation"`
+
+	// BackupDirRetries is how often creating BackupDir, creating the
+	// backup in it or renaming it into place is retried after a transient
+	// error of network storage, e.g. a stale NFS handle or an expired
+	// automount. BackupDirBackoff is the wait before the first retry,
+	// doubled on each further one, see DefaultBackupDirBackoff.
+	BackupDirRetries int      `toml:"backup_dir_retries" json:"backup_dir_retries" yaml:"backup_dir_retries"`
+	BackupDirBackoff Duration `toml:"backup_dir_backoff" json:"backup_dir_backoff" yaml:"backup_dir_backoff"`
+
+	// BundleSources are related databases, e.g. an attached analytics
+	// database, backed up in every run together with SourcePath and
+	// written with it into a single bundle, see BundleExtension. The
+	// backup of SourcePath is complete, with its marker, checkpoint and
+	// retention, before the bundle sources are backed up. Every backup
+	// also stays in BackupDir on its own, next to the bundle.
+	BundleSources []string `toml:"bundle_sources" json:"bundle_sources" yaml:"bundle_sources"`
+
+	// ScratchDir, if set, is a directory on fast local storage the backup
+	// is compressed in before it is moved to BackupDir, e.g. when
+	// BackupDir is slow network storage.
+	ScratchDir string `toml:"scratch_dir" json:"scratch_dir" yaml:"scratch_dir"`
+
+	// SkipIfNewerBackup lists BackupDir before the backup is written and
+	// skips it if another instance wrote a newer backup of the database
+	// since the run started.
+	SkipIfNewerBackup bool `toml:"skip_if_newer_backup" json:"skip_if_newer_backup" yaml:"skip_if_newer_backup"`
+
+	// PrometheusTextfile is the path of a .prom file the stats are
+	// written to after every run, for the textfile collector of
+	// node_exporter.
+	PrometheusTextfile string `toml:"prometheus_textfile" json:"prometheus_textfile" yaml:"prometheus_textfile"`
+
+	// LogRowCounts logs the number of tables and rows of every backup.
+	// Counting reads every table of the copy, leave it off for huge
+	// databases.
+	LogRowCounts bool `toml:"log_row_counts" json:"log_row_counts" yaml:"log_row_counts"`
+
+	// CheckpointAfterBackup runs PRAGMA wal_checkpoint(TRUNCATE) on the
+	// source after every successful backup. Requires write access.
+	CheckpointAfterBackup bool `toml:"checkpoint_after_backup" json:"checkpoint_after_backup" yaml:"checkpoint_after_backup"`
+
+	// DirtySourcePolicy checks the source for a hot journal, a WAL
+	// without its -shm index or outgrowing the database, and runs
+	// PRAGMA quick_check before the backup: ignore (default), warn, refuse
+	// or checkpoint (recover and truncate the WAL, then check again).
+	DirtySourcePolicy string `toml:"dirty_source_policy" json:"dirty_source_policy" yaml:"dirty_source_policy"`
+
+	// AgeRecipients are the age public keys every backup is encrypted to,
+	// any of their identities can decrypt it. AgeRecipient is deprecated,
+	// it is still encrypted to, and MigrateConfig moves it to
+	// AgeRecipients. EncryptSidecars also encrypts the manifest, which
+	// would otherwise leak details of the backup in plaintext.
+	AgeRecipient    string   `toml:"age_recipient,omitempty" json:"age_recipient,omitempty" yaml:"age_recipient,omitempty"`
+	AgeRecipients   []string `toml:"age_recipients" json:"age_recipients" yaml:"age_recipients"`
+	EncryptSidecars bool     `toml:"encrypt_sidecars" json:"encrypt_sidecars" yaml:"encrypt_sidecars"`
+
+	// KMSKeyID enables envelope encryption: every backup is encrypted to
+	// a fresh data key, stored in the manifest wrapped by the KeyWrapper
+	// under this key id, e.g. an AWS KMS key ARN.
+	KMSKeyID string `toml:"kms_key_id" json:"kms_key_id" yaml:"kms_key_id"`
+
+	// LowPriority runs the backup with the lowest CPU and I/O priority, so
+	// it yields to the application. Linux only, ignored with a warning on
+	// other platforms.
+	LowPriority bool `toml:"low_priority" json:"low_priority" yaml:"low_priority"`
+
+	// StaleTempFileAge, if set, makes NewHandler remove temporary backup
+	// files older than it, e.g. left behind by a crash.
+	StaleTempFileAge Duration `toml:"stale_temp_file_age" json:"stale_temp_file_age" yaml:"stale_temp_file_age"`
+
+	// DurationWindow is the number of recent successful runs the
+	// duration percentiles in Stats are computed over, see
+	// DefaultDurationWindow. A run longer than their p95 times
+	// SlowRunFactor is logged as a warning, 0 disables the warning.
+	DurationWindow int     `toml:"duration_window" json:"duration_window" yaml:"duration_window"`
+	SlowRunFactor  float64 `toml:"slow_run_factor" json:"slow_run_factor" yaml:"slow_run_factor"`
+
+	// LogArchive, if set, is a log archive every finished backup is
+	// appended to, see AppendToLogArchive.
+	LogArchive string `toml:"log_archive" json:"log_archive" yaml:"log_archive"`
+
+	// MarkerPath, if set, is a JSON file atomically replaced after every
+	// successful backup with its path, time and checksum, see Marker.
+	MarkerPath string `toml:"marker_path" json:"marker_path" yaml:"marker_path"`
+
+	// KeepLast maps a strategy to the number of its newest backups kept
+	// per database, e.g. {vacuum = 30, online = 7}. Older ones are removed
+	// after each backup. Strategies without an entry are never removed.
+	KeepLast map[string]int `toml:"keep_last" json:"keep_last" yaml:"keep_last"`
+	// RetentionGracePeriod delays the removal of backups that fell out of
+	// KeepLast, see PruneOptions.GracePeriod.
+	RetentionGracePeriod Duration `toml:"retention_grace_period" json:"retention_grace_period" yaml:"retention_grace_period"`
+
+	// ExportTable and ExportColumn select the rows exported by
+	// StrategyExport. ExportStateFile stores the watermark, by default
+	// .<database>-<table>.export.json in BackupDir.
+	ExportTable     string `toml:"export_table" json:"export_table" yaml:"export_table"`
+	ExportColumn    string `toml:"export_column" json:"export_column" yaml:"export_column"`
+	ExportStateFile string `toml:"export_state_file" json:"export_state_file" yaml:"export_state_file"`
+
+	// MaxPageCountDrop, if set, is the fraction, e.g. 0.5, the page count
+	// of the source may drop since the previous backup. A larger drop is
+	// logged as a warning, and with PageCountDropAction skip_retention
+	// the older backups are kept. The page count is read from manifests.
+	MaxPageCountDrop    float64 `toml:"max_page_count_drop" json:"max_page_count_drop" yaml:"max_page_count_drop"`
+	PageCountDropAction string  `toml:"page_count_drop_action" json:"page_count_drop_action" yaml:"page_count_drop_action"`
+
+	// ExistingBackupPolicy handles a final backup path that already
+	// exists: error (default), overwrite or skip the backup.
+	ExistingBackupPolicy string `toml:"existing_backup_policy" json:"existing_backup_policy" yaml:"existing_backup_policy"`
+
+	// InProgressSuffix is appended to a backup while it is written, before
+	// it is renamed into place. Defaults to DefaultInProgressSuffix.
+	InProgressSuffix string `toml:"in_progress_suffix" json:"in_progress_suffix" yaml:"in_progress_suffix"`
+
+	// Manifest writes a JSON sidecar describing each backup.
+	Manifest bool `toml:"manifest" json:"manifest" yaml:"manifest"`
+
+	// SigningKeyPath is a PEM encoded Ed25519 private key every backup
+	// is signed with, see LoadSigningKey. The detached signature is
+	// written next to the backup with SignatureExtension.
+	SigningKeyPath string `toml:"signing_key_path" json:"signing_key_path" yaml:"signing_key_path"`
+
+	// HTTPMeta writes a sidecar with the content type, length and
+	// disposition of each backup, for serving it over HTTP, see Meta.
+	HTTPMeta bool `toml:"http_meta" json:"http_meta" yaml:"http_meta"`
+
+	// MaintenanceStart and MaintenanceEnd, HH:MM in server local time,
+	// define a daily window during which jobs are skipped, e.g. while
+	// heavy migrations run. MaintenanceDays (sun, mon, ...) restricts it
+	// to the days the window starts on.
+	MaintenanceStart string   `toml:"maintenance_start" json:"maintenance_start" yaml:"maintenance_start"`
+	MaintenanceEnd   string   `toml:"maintenance_end" json:"maintenance_end" yaml:"maintenance_end"`
+	MaintenanceDays  []string `toml:"maintenance_days" json:"maintenance_days" yaml:"maintenance_days"`
+
+	// FileMode and DirMode, octal like "0640", if set, are the modes of
+	// every file and directory the handler creates, independent of the
+	// process umask. Without FileMode files are created with mode 0600,
+	// without DirMode directories get 0755 masked by the umask.
+	FileMode string `toml:"file_mode" json:"file_mode" yaml:"file_mode"`
+	DirMode  string `toml:"dir_mode" json:"dir_mode" yaml:"dir_mode"`
+
+	// UID and GID, if set, become the owner of BackupDir and of every
+	// file written to it.
+	UID *int `toml:"uid,omitempty" json:"uid,omitempty" yaml:"uid,omitempty"`
+	GID *int `toml:"gid,omitempty" json:"gid,omitempty" yaml:"gid,omitempty"`
 }
 
 // Handler handles database backup jobs
 type Handler struct {
-	cfg    *Config
-	logger *slog.Logger
+	cfg     *Config
+	logger  *slog.Logger
+	metrics *metrics
+
+	// strategies are the strategies added by RegisterStrategy.
+	strategies map[string]Strategy
+
+	// allowedSources are the resolved paths set by RestrictSourcePaths,
+	// nil for no restriction.
+	allowedSources []string
+
+	// keyWrapper is set by SetKeyWrapper. dataKeyRecipient is the data
+	// key of the current run, set on the per-run copy of the handler.
+	keyWrapper       KeyWrapper
+	dataKeyRecipient age.Recipient
 }
 
 // NewHandler creates a new Handler
@@ -41,10 +266,20 @@ func NewHandler(cfg *Config, logger *slog.Logger) *Handler {
 	if cfg == nil || logger == nil {
 		panic("NewHandler: received nil config or logger")
 	}
-	return &Handler{
-		cfg:    cfg,
-		logger: logger.With("job_handler", "sqlite_backup"),
+	h := &Handler{
+		cfg:     cfg,
+		logger:  logger.With("job_handler", "sqlite_backup"),
+		metrics: newMetrics(cfg.DurationWindow),
 	}
+	h.cleanupStaleTempFiles()
+	return h
+}
+
+// withLogger returns a shallow copy of the handler using logger.
+func (h *Handler) withLogger(logger *slog.Logger) *Handler {
+	clone := *h
+	clone.logger = logger
+	return &clone
 }
 
 // GenerateBlueprintConfig creates a default configuration for a new setup.
@@ -52,18 +287,114 @@ func GenerateBlueprintConfig() Config {
 	return Config{
 		SourcePath:    "/path/to/your/database.db",
 		BackupDir:     "/path/to/your/backups",
-		Strategy:      StrategyOnline,
-		PagesPerStep:  100,
-		SleepInterval: Duration{Duration: 10 * time.Millisecond},
+		Strategy:      DefaultStrategy,
+		PagesPerStep:  DefaultPagesPerStep,
+		SleepInterval: Duration{Duration: DefaultSleepInterval},
+		Compression:   DefaultCompression,
 	}
 }
 
 // Handle implements the JobHandler interface for database backups
 func (h *Handler) Handle(ctx context.Context, job db.Job) error {
+	payload, err := parseJobPayload(job)
+	if err != nil {
+		h.recordRun(time.Now(), nil, err)
+		return err
+	}
+	reason := payload.Reason
+	if reason == "" {
+		reason = ReasonScheduled
+	}
+	_, err = h.run(ctx, reason, payload.Labels)
+	return err
+}
+
+// run runs a backup with the settings of the handler, the core of Handle
+// and Backup.
+func (h *Handler) run(ctx context.Context, reason string, labels map[string]string) (*Result, error) {
+	// Every log line and the manifest of this run carry the same run id
+	// and reason
+	runID := uuid.NewString()
+	h = h.withLogger(h.logger.With("run_id", runID, "reason", reason))
+	result := &Result{RunID: runID}
+
+	startedAt := time.Now()
+	inWindow, err := h.inMaintenanceWindow(startedAt)
+	if err != nil {
+		return nil, err
+	}
+	if inWindow {
+		h.logger.Info("Within maintenance window, skipping backup", "start", h.cfg.MaintenanceStart, "end", h.cfg.MaintenanceEnd)
+		return result, nil
+	}
+
+	var manifest *Manifest
+	backup := func() error {
+		manifest, err = h.backup(ctx, runID, reason, labels, startedAt)
+		if err == nil && manifest != nil && len(h.cfg.BundleSources) > 0 {
+			_, err = h.backupBundle(ctx, runID, reason, labels, startedAt, manifest)
+		}
+		return err
+	}
+	if h.cfg.LowPriority {
+		err = h.runLowPriority(backup)
+	} else {
+		err = backup()
+	}
+	result.Duration = time.Since(startedAt)
+	if err == nil && manifest != nil {
+		h.checkSlowRun(result.Duration)
+	}
+	h.recordRun(startedAt, manifest, err)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest != nil {
+		result.Manifest = manifest
+		result.Path = filepath.Join(h.cfg.BackupDir, manifest.BackupFile)
+	}
+	return result, nil
+}
+
+// recordRun records the outcome of a run in the stats and, if configured,
+// in the Prometheus textfile.
+func (h *Handler) recordRun(startedAt time.Time, manifest *Manifest, err error) {
+	h.metrics.record(startedAt, manifest, err)
+	if h.cfg.PrometheusTextfile != "" {
+		h.writePrometheusTextfile(err != nil)
+	}
+}
+
+// checkSlowRun warns when a successful run took longer than the p95 of
+// the recent runs times Config.SlowRunFactor, often a sign of a growing
+// database or I/O contention.
+func (h *Handler) checkSlowRun(duration time.Duration) {
+	threshold, ok := h.metrics.slowRunThreshold(h.cfg.SlowRunFactor)
+	if ok && duration > threshold {
+		h.logger.Warn("Backup took longer than usual", "duration", duration, "threshold", threshold, "slow_run_factor", h.cfg.SlowRunFactor)
+	}
+}
+
+// backup runs a single backup and returns the manifest of the written file.
+// The backup is named after startedAt, the start of the run.
+func (h *Handler) backup(ctx context.Context, runID, reason string, labels map[string]string, startedAt time.Time) (*Manifest, error) {
 	// --- Define Paths and Filenames ---
-	sourceDbPath := h.cfg.SourcePath
+	// The source is resolved so a symlinked database gets the filename of
+	// its target and the safety guards compare real paths.
+	sourceDbPath, err := filepath.EvalSymlinks(h.cfg.SourcePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve source path %q: %w", h.cfg.SourcePath, err)
+	}
+	sourceDbPath, err = filepath.Abs(sourceDbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve source path %q: %w", h.cfg.SourcePath, err)
+	}
+	if err := h.checkSourceAllowed(sourceDbPath); err != nil {
+		return nil, err
+	}
 	backupDir := h.cfg.BackupDir
-	tempBackupPath := filepath.Join(os.TempDir(), fmt.Sprintf("backup-%d.db", time.Now().UnixNano()))
+	tempBackupPath := newTempBackupPath()
 
 	strategyForFilename := h.cfg.Strategy
 	if strategyForFilename == "" {
@@ -72,37 +403,277 @@ func (h *Handler) Handle(ctx context.Context, job db.Job) error {
 
 	baseName := filepath.Base(sourceDbPath)
 	fileNameOnly := strings.TrimSuffix(baseName, filepath.Ext(baseName))
-	timestamp := time.Now().UTC().Format("2006-01-02T15-04-05Z")
-	finalBackupName := fmt.Sprintf("%s-%s-%s.bck.gz", fileNameOnly, timestamp, strategyForFilename)
+	startedAt = startedAt.UTC()
+	extension, err := compressionExtension(h.cfg.Compression)
+	if err != nil {
+		return nil, err
+	}
+	baseExtension := BackupExtension
+	if h.cfg.Strategy == StrategyForensic {
+		baseExtension = ArchiveExtension
+	}
+	if err := h.validateEncryptionConfig(); err != nil {
+		return nil, err
+	}
+	// A bundle that cannot be written fails the run before the backup of
+	// the source is
+	if err := h.validateBundleConfig(); err != nil {
+		return nil, err
+	}
+	// The key is loaded before the backup, so a missing key does not
+	// leave an unsigned backup behind
+	var signingKey ed25519.PrivateKey
+	if h.cfg.SigningKeyPath != "" {
+		if signingKey, err = LoadSigningKey(h.cfg.SigningKeyPath); err != nil {
+			return nil, err
+		}
+	}
+	if h.cfg.FallbackStrategy != "" && h.cfg.FallbackStrategy != StrategyVacuum {
+		return nil, fmt.Errorf("unsupported fallback strategy: %q, only %q is supported", h.cfg.FallbackStrategy, StrategyVacuum)
+	}
+	finalBackupName, err := h.backupFilename(fileNameOnly, startedAt, strategyForFilename, baseExtension+extension+h.encryptionExtension())
+	if err != nil {
+		return nil, err
+	}
 
 	finalBackupPath := filepath.Join(backupDir, finalBackupName)
 
-	h.logger.Info("Starting database backup process", "source", sourceDbPath, "strategy", h.cfg.Strategy, "destination", finalBackupPath)
+	if err := h.retryDirOp(ctx, "mkdir", backupDir, "", func() error { return os.MkdirAll(backupDir, 0755) }); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	if err := h.applyPermissions(backupDir); err != nil {
+		return nil, err
+	}
+
+	for _, dest := range []string{tempBackupPath, finalBackupPath} {
+		if err := ensureDistinct(sourceDbPath, dest); err != nil {
+			return nil, err
+		}
+	}
+	if skip, err := h.checkExistingBackup(finalBackupPath); skip || err != nil {
+		return nil, err
+	}
+
+	if sourceDbPath != h.cfg.SourcePath {
+		h.logger.Info("Resolved source database path", "configured", h.cfg.SourcePath, "resolved", sourceDbPath)
+	}
+
+	h.logger.Info("Starting database backup process", "source", sourceDbPath, "strategy", h.cfg.Strategy, "compression", h.cfg.Compression, "destination", finalBackupPath)
+
+	if err := h.checkSource(sourceDbPath); err != nil {
+		return nil, err
+	}
+
+	var pageCount int64
+	var skipRetention bool
+	if h.cfg.MaxPageCountDrop > 0 {
+		if pageCount, err = sourcePageCount(sourceDbPath); err != nil {
+			return nil, err
+		}
+		if skipRetention, err = h.checkPageCountDrop(fileNameOnly, pageCount); err != nil {
+			return nil, err
+		}
+	}
 
 	// --- Dispatch to the chosen backup strategy ---
-	var backupErr error
-	switch h.cfg.Strategy {
-	case StrategyVacuum:
-		backupErr = h.vacuumInto(sourceDbPath, tempBackupPath)
-	case StrategyOnline, "":
-		backupErr = h.onlineBackup(sourceDbPath, tempBackupPath)
-	default:
-		return fmt.Errorf("unknown backup strategy: %q", h.cfg.Strategy)
+	// Vacuum and forensic copies capture the source as it was when they
+	// start, they block writers for their duration.
+	s, err := h.lookupStrategy(h.cfg.Strategy)
+	if err != nil {
+		return nil, err
+	}
+	if s.validate != nil {
+		if err := s.validate(h); err != nil {
+			return nil, err
+		}
+	}
+	run := &strategyRun{
+		database:   fileNameOnly,
+		source:     sourceDbPath,
+		dest:       tempBackupPath,
+		capturedAt: time.Now(),
+	}
+	backupErr := s.backup(ctx, h, run)
+	capturedAt, export := run.capturedAt, run.export
+
+	if errors.Is(backupErr, errTooManyRestarts) && h.cfg.FallbackStrategy != "" {
+		h.logger.Warn("Online backup exceeded the restart limit, falling back to another strategy",
+			"max_restarts", h.cfg.MaxRestarts,
+			"fallback_strategy", h.cfg.FallbackStrategy,
+		)
+		// The backup is named after the strategy that produced it
+		strategyForFilename = h.cfg.FallbackStrategy
+		finalBackupName, err = h.backupFilename(fileNameOnly, startedAt, strategyForFilename, baseExtension+extension+h.encryptionExtension())
+		if err != nil {
+			os.Remove(tempBackupPath)
+			return nil, err
+		}
+		finalBackupPath = filepath.Join(backupDir, finalBackupName)
+		if err := ensureDistinct(sourceDbPath, finalBackupPath); err != nil {
+			os.Remove(tempBackupPath)
+			return nil, err
+		}
+		if skip, err := h.checkExistingBackup(finalBackupPath); skip || err != nil {
+			os.Remove(tempBackupPath)
+			return nil, err
+		}
+		// VACUUM INTO refuses to overwrite the partial online copy
+		os.Remove(tempBackupPath)
+		capturedAt = time.Now()
+		backupErr = h.vacuumInto(ctx, sourceDbPath, tempBackupPath)
 	}
 
 	if backupErr != nil {
-		return fmt.Errorf("backup creation failed: %w", backupErr)
+		os.Remove(tempBackupPath)
+		return nil, fmt.Errorf("backup creation failed: %w", backupErr)
 	}
 	defer os.Remove(tempBackupPath)
 	h.logger.Info("Successfully created temporary backup database", "path", tempBackupPath)
 
-	// --- Gzip and Finalize ---
-	if err := h.compressFile(tempBackupPath, finalBackupPath); err != nil {
-		return fmt.Errorf("failed to gzip backup file: %w", err)
+	if err := h.checkCaptureAge(capturedAt); err != nil {
+		return nil, err
+	}
+	if h.cfg.SkipIfNewerBackup {
+		if skip, err := h.checkNewerBackup(finalBackupPath, startedAt); skip || err != nil {
+			return nil, err
+		}
+	}
+
+	// --- Compress and Finalize ---
+	compression := h.cfg.Compression
+	if compression == "" {
+		compression = DefaultCompression
+	}
+	manifest := &Manifest{
+		Source:      sourceDbPath,
+		Strategy:    strategyForFilename,
+		Compression: compression,
+		CreatedAt:   startedAt,
+		RunID:       runID,
+		Reason:      reason,
+		Encrypted:   h.encrypted(),
+		Labels:      labels,
+		CapturedAt:  capturedAt.UTC(),
+		Export:      export,
+		PageCount:   pageCount,
+	}
+	if h.envelopeEncrypted() {
+		if err := h.newDataKey(ctx, manifest); err != nil {
+			return nil, err
+		}
+	}
+	finalBackupPath, err = h.compressAndFinalize(ctx, tempBackupPath, finalBackupPath, manifest)
+	if errors.Is(err, errNewerBackup) || errors.Is(err, errBackupExists) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress backup file: %w", err)
 	}
 	h.logger.Info("Successfully compressed backup", "path", finalBackupPath)
+	if err := h.applyPermissions(finalBackupPath); err != nil {
+		return nil, err
+	}
+
+	written := []string{finalBackupPath}
+	if h.cfg.SigningKeyPath != "" {
+		sigPath, err := h.signBackup(signingKey, finalBackupPath, manifest)
+		if err != nil {
+			return nil, err
+		}
+		if err := h.applyPermissions(sigPath); err != nil {
+			return nil, err
+		}
+		h.logger.Info("Successfully signed backup", "path", sigPath)
+		written = append(written, sigPath)
+	}
+
+	// Labels, the reason of unscheduled runs, the wrapped data key, the
+	// signing key and the page count compared by the next run are only
+	// stored in the manifest
+	if h.cfg.Manifest || len(labels) > 0 || reason != ReasonScheduled || h.envelopeEncrypted() || h.cfg.SigningKeyPath != "" || pageCount > 0 {
+		manifestPath, err := h.writeManifest(finalBackupPath, manifest)
+		if err != nil {
+			return nil, err
+		}
+		if err := h.applyPermissions(manifestPath); err != nil {
+			return nil, err
+		}
+		h.logger.Info("Successfully wrote backup manifest", "path", manifestPath)
+		written = append(written, manifestPath)
+	}
+	if h.cfg.HTTPMeta {
+		metaPath, err := h.writeMeta(finalBackupPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := h.applyPermissions(metaPath); err != nil {
+			return nil, err
+		}
+		written = append(written, metaPath)
+	}
+
+	if h.cfg.LogRowCounts {
+		h.logRowCounts(ctx, tempBackupPath)
+	}
+
+	if h.cfg.VerifyAfterBackup {
+		if err := h.verifyWritten(ctx, tempBackupPath, finalBackupPath); err != nil {
+			return nil, err
+		}
+	}
+
+	// The watermark only advances once the export is safely written
+	if export != nil {
+		statePath := h.exportStatePath(fileNameOnly)
+		if err := h.writeExportState(statePath, export); err != nil {
+			return nil, err
+		}
+		h.logger.Info("Successfully updated export state", "path", statePath, "watermark", export.Through)
+	}
+
+	if h.cfg.LogArchive != "" {
+		if err := h.appendToLogArchive(finalBackupPath); err != nil {
+			return nil, err
+		}
+	}
+
+	h.mirrorBackup(sourceDbPath, written...)
+
+	if h.cfg.CheckpointAfterBackup {
+		h.checkpointAfterBackup(ctx, sourceDbPath)
+	}
+
+	if h.cfg.MarkerPath != "" {
+		if err := h.writeMarker(finalBackupPath, manifest); err != nil {
+			return nil, err
+		}
+		h.logger.Info("Successfully updated backup marker", "path", h.cfg.MarkerPath)
+	}
+
+	if skipRetention {
+		h.logger.Warn("Skipping retention, the older backups are kept", "keep_last", h.cfg.KeepLast)
+	} else {
+		h.pruneBackups()
+	}
 
 	h.logger.Info("Database backup process completed successfully")
+	return manifest, nil
+}
+
+// checkCaptureAge warns about, or fails on, a copy whose captured source
+// state is older than Config.MaxCaptureAge.
+func (h *Handler) checkCaptureAge(capturedAt time.Time) error {
+	if h.cfg.MaxCaptureAge.Duration <= 0 {
+		return nil
+	}
+	age := time.Since(capturedAt)
+	if age <= h.cfg.MaxCaptureAge.Duration {
+		return nil
+	}
+	if h.cfg.FailOnStaleCapture {
+		return fmt.Errorf("backup captured a stale source state: captured %v before completion, max %v", age, h.cfg.MaxCaptureAge.Duration)
+	}
+	h.logger.Warn("Backup captured a stale source state", "captured_at", capturedAt, "age", age, "max_capture_age", h.cfg.MaxCaptureAge.Duration)
 	return nil
 }
 
@@ -118,12 +689,14 @@ func (h *Handler) validateOnlineConfig() error {
 }
 
 // vacuumInto creates a clean, defragmented copy of the database.
-func (h *Handler) vacuumInto(sourcePath, destPath string) error {
+func (h *Handler) vacuumInto(ctx context.Context, sourcePath, destPath string) error {
 	sourceConn, err := sqlite.OpenConn(sourcePath, sqlite.OpenReadOnly)
 	if err != nil {
 		return fmt.Errorf("failed to open source db for vacuum: %w", err)
 	}
 	defer sourceConn.Close()
+	// VACUUM INTO is a single step, only an interrupt can abort it
+	sourceConn.SetInterrupt(ctx.Done())
 
 	stmt, err := sourceConn.Prepare(fmt.Sprintf("VACUUM INTO '%s';", destPath))
 	if err != nil {
@@ -131,16 +704,52 @@ func (h *Handler) vacuumInto(sourcePath, destPath string) error {
 	}
 	defer stmt.Finalize()
 
+	stop := h.vacuumHeartbeat(time.Now())
+	defer stop()
+
 	if _, err := stmt.Step(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return fmt.Errorf("vacuum canceled: %w", ctxErr)
+		}
 		return fmt.Errorf("failed to execute vacuum statement: %w", err)
 	}
 	return nil
 }
 
+// vacuumHeartbeatInterval is how often a running vacuum is logged.
+const vacuumHeartbeatInterval = 30 * time.Second
+
+// vacuumHeartbeat logs every vacuumHeartbeatInterval that the vacuum
+// started at start is still running, until stop is called. VACUUM INTO
+// reports no progress of its own.
+func (h *Handler) vacuumHeartbeat(start time.Time) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(vacuumHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				h.logger.Info("Vacuum still running", "elapsed", time.Since(start).Round(time.Second))
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// errTooManyRestarts is returned by onlineBackup when the copy restarted
+// more often than Config.MaxRestarts.
+var errTooManyRestarts = errors.New("online backup exceeded the restart limit")
+
 // onlineBackup performs a live backup using the SQLite Online Backup API.
-func (h *Handler) onlineBackup(sourcePath, destPath string) error {
+// It returns the time of the source state captured by the copy. A write by
+// another connection restarts the copy, so a completed copy reflects the
+// source at completion, unless a snapshot is held.
+func (h *Handler) onlineBackup(ctx context.Context, sourcePath, destPath string) (time.Time, error) {
 	if err := h.validateOnlineConfig(); err != nil {
-		return err
+		return time.Time{}, err
 	}
 
 	pagesPerStep := h.cfg.PagesPerStep
@@ -148,19 +757,28 @@ func (h *Handler) onlineBackup(sourcePath, destPath string) error {
 
 	srcConn, err := sqlite.OpenConn(sourcePath, sqlite.OpenReadOnly)
 	if err != nil {
-		return fmt.Errorf("failed to open source db for online backup: %w", err)
+		return time.Time{}, fmt.Errorf("failed to open source db for online backup: %w", err)
 	}
 	defer srcConn.Close()
 
+	if h.cfg.SnapshotIsolation {
+		if err := beginReadSnapshot(srcConn); err != nil {
+			return time.Time{}, err
+		}
+		defer sqlitex.ExecuteTransient(srcConn, "ROLLBACK;", nil)
+		h.logger.Info("Holding read snapshot on source database for the online copy")
+	}
+	snapshotAt := time.Now()
+
 	destConn, err := sqlite.OpenConn(destPath, sqlite.OpenCreate|sqlite.OpenReadWrite)
 	if err != nil {
-		return fmt.Errorf("failed to create destination db for online backup: %w", err)
+		return time.Time{}, fmt.Errorf("failed to create destination db for online backup: %w", err)
 	}
 	defer destConn.Close()
 
 	backup, err := sqlite.NewBackup(destConn, "main", srcConn, "main")
 	if err != nil {
-		return fmt.Errorf("failed to initialize backup: %w", err)
+		return time.Time{}, fmt.Errorf("failed to initialize backup: %w", err)
 	}
 	defer func() {
 		if err := backup.Close(); err != nil {
@@ -171,26 +789,45 @@ func (h *Handler) onlineBackup(sourcePath, destPath string) error {
 	// Initialize the progress logger
 	logger, err := newModuloLogger(h.logger, backup)
 	if err != nil {
-		return err
+		return time.Time{}, err
 	}
 	if logger == nil { // This happens if the database is empty
 		h.logger.Info("Source database is empty. Backup completed immediately.")
-		return nil
+		return time.Now(), nil
 	}
 
 	h.logger.Info("Starting online backup copy", "pages_per_step", pagesPerStep, "sleep_interval", sleepInterval, "total_pages", logger.totalPages)
 
+	remaining := backup.Remaining()
+	restarts := 0
 	for {
+		if err := ctx.Err(); err != nil {
+			return time.Time{}, fmt.Errorf("online backup canceled: %w", err)
+		}
+
 		more, err := backup.Step(pagesPerStep)
 		if err != nil {
-			return fmt.Errorf("backup step failed: %w", err)
+			return time.Time{}, fmt.Errorf("backup step failed: %w", err)
 		}
 
 		if !more {
 			logger.LogFinal(backup)
 			h.logger.Info("Online backup copy completed successfully.")
-			return nil
+			if h.cfg.SnapshotIsolation {
+				return snapshotAt, nil
+			}
+			return time.Now(), nil
+		}
+
+		// A write to the source by another connection restarts the copy
+		if backup.Remaining() > remaining {
+			restarts++
+			h.logger.Info("Online backup restarted by a write to the source", "restarts", restarts)
+			if h.cfg.MaxRestarts > 0 && restarts > h.cfg.MaxRestarts {
+				return time.Time{}, fmt.Errorf("%w: %d", errTooManyRestarts, h.cfg.MaxRestarts)
+			}
 		}
+		remaining = backup.Remaining()
 
 		logger.Log(backup)
 
@@ -200,6 +837,22 @@ func (h *Handler) onlineBackup(sourcePath, destPath string) error {
 	}
 }
 
+// beginReadSnapshot starts a read transaction on conn. While it is open,
+// every backup step reads the same snapshot of the database, so writers
+// committing on other connections neither change the copy nor force the
+// backup to restart.
+func beginReadSnapshot(conn *sqlite.Conn) error {
+	if err := sqlitex.ExecuteTransient(conn, "BEGIN DEFERRED;", nil); err != nil {
+		return fmt.Errorf("failed to begin read transaction on source db: %w", err)
+	}
+	// A deferred transaction only takes its snapshot on the first read
+	if err := sqlitex.ExecuteTransient(conn, "SELECT count(*) FROM sqlite_master;", nil); err != nil {
+		sqlitex.ExecuteTransient(conn, "ROLLBACK;", nil)
+		return fmt.Errorf("failed to start read snapshot on source db: %w", err)
+	}
+	return nil
+}
+
 // --- Modulo Logger ---
 
 // moduloLogger encapsulates the logic for logging backup progress.
@@ -257,32 +910,6 @@ func (m *moduloLogger) log(backup *sqlite.Backup) {
 	)
 }
 
-// --- Other Helpers ---
-
-// compressFile reads a source file, compresses it with gzip, and writes to a destination file.
-func (h *Handler) compressFile(sourcePath, destPath string) error {
-	sourceFile, err := os.Open(sourcePath)
-	if err != nil {
-		return fmt.Errorf("failed to open source file for compression: %w", err)
-	}
-	defer sourceFile.Close()
-
-	destFile, err := os.Create(destPath)
-	if err != nil {
-		return fmt.Errorf("failed to create destination file for compression: %w", err)
-	}
-	defer destFile.Close()
-
-	gzipWriter := gzip.NewWriter(destFile)
-	defer gzipWriter.Close()
-
-	if _, err := io.Copy(gzipWriter, sourceFile); err != nil {
-		return fmt.Errorf("failed to copy and compress data: %w", err)
-	}
-
-	return nil
-}
-
 // Duration is a wrapper around time.Duration that supports TOML marshalling
 // to and from a string value (e.g., "3h", "15m", "1h30m").
 type Duration struct {
@@ -302,4 +929,4 @@ func (d *Duration) UnmarshalText(text []byte) error {
 // MarshalText implements the encoding.TextMarshaler interface.
 func (d Duration) MarshalText() ([]byte, error) {
 	return []byte(d.Duration.String()), nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,29 @@
+package sqlitebackup
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// discardLogger returns a logger dropping everything.
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// createTestDatabase creates a small database at path.
+func createTestDatabase(t *testing.T, path string) {
+	t.Helper()
+	conn, err := sqlite.OpenConn(path, sqlite.OpenCreate|sqlite.OpenReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	script := "CREATE TABLE t (x TEXT); INSERT INTO t VALUES ('a'), ('b'), ('c');"
+	if err := sqlitex.ExecuteScript(conn, script, nil); err != nil {
+		t.Fatal(err)
+	}
+}
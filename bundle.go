@@ -0,0 +1,327 @@
+package sqlitebackup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BundleExtension is the extension of a bundle, a gzip compressed tar
+// archive holding the backups of one run of the source and of
+// Config.BundleSources, together with their sidecars. A bundle is named
+// after the backup of the source, e.g. app-2024-07-01T10-00-00Z-online.bundle.tgz.
+//
+// The first member is bundleIndexName, a JSON list of the other members
+// with their size and SHA-256, see BundleMember. The members follow in
+// the same order, each backup followed by its sidecars. Member names are
+// plain filenames, the archive has no directories.
+const BundleExtension = ".bundle.tgz"
+
+// bundleIndexName is the name of the index member of a bundle.
+const bundleIndexName = "bundle.json"
+
+// BundleMember describes a file stored in a bundle.
+type BundleMember struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// BundleName returns the name of the bundle of the backup named name.
+func BundleName(name string) (string, error) {
+	bf, err := ParseBackupFilename(name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(name, bf.Extension) + BundleExtension, nil
+}
+
+// backupSidecars returns the paths of the sidecars of the backup at
+// backupPath that exist.
+func backupSidecars(backupPath string) ([]string, error) {
+	manifestPath := strings.TrimSuffix(backupPath, EncryptionExtension) + ManifestExtension
+	var sidecars []string
+	for _, p := range []string{manifestPath, manifestPath + EncryptionExtension, backupPath + MetaExtension, backupPath + SignatureExtension} {
+		if _, err := os.Stat(p); err == nil {
+			sidecars = append(sidecars, p)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to stat sidecar: %w", err)
+		}
+	}
+	return sidecars, nil
+}
+
+// writeBundle writes the backups at backupPaths and their sidecars into
+// a bundle at bundlePath. The bundle is written next to bundlePath and
+// renamed into place once complete.
+func (h *Handler) writeBundle(bundlePath string, backupPaths []string) error {
+	var paths []string
+	for _, backupPath := range backupPaths {
+		sidecars, err := backupSidecars(backupPath)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, backupPath)
+		paths = append(paths, sidecars...)
+	}
+
+	members := make([]BundleMember, 0, len(paths))
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		name := filepath.Base(path)
+		if seen[name] {
+			return fmt.Errorf("duplicate bundle member %q", name)
+		}
+		seen[name] = true
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("failed to stat %q: %w", path, err)
+		}
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return err
+		}
+		members = append(members, BundleMember{Name: name, Size: info.Size(), SHA256: sum})
+	}
+	index, err := json.MarshalIndent(members, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal bundle index: %w", err)
+	}
+
+	inProgressPath := bundlePath + h.inProgressSuffix()
+	if err := h.writeBundleFile(inProgressPath, index, paths); err != nil {
+		os.Remove(inProgressPath)
+		return err
+	}
+	if err := os.Rename(inProgressPath, bundlePath); err != nil {
+		os.Remove(inProgressPath)
+		return fmt.Errorf("failed to rename bundle into place: %w", err)
+	}
+	return nil
+}
+
+// writeBundleFile writes the index followed by the files at paths into a
+// new bundle at path.
+func (h *Handler) writeBundleFile(path string, index []byte, paths []string) error {
+	file, err := h.createFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to create bundle: %w", err)
+	}
+	defer file.Close()
+
+	// The backups are compressed already, a higher level gains little
+	gz, err := gzip.NewWriterLevel(file, gzip.BestSpeed)
+	if err != nil {
+		return fmt.Errorf("failed to start bundle compression: %w", err)
+	}
+	tw := tar.NewWriter(gz)
+
+	header := &tar.Header{Name: bundleIndexName, Mode: 0644, Size: int64(len(index)), ModTime: time.Now(), Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write bundle index header: %w", err)
+	}
+	if _, err := tw.Write(index); err != nil {
+		return fmt.Errorf("failed to write bundle index: %w", err)
+	}
+	for _, p := range paths {
+		if err := addFileToTar(tw, p, filepath.Base(p)); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to finish bundle archive: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to finish bundle compression: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync bundle: %w", err)
+	}
+	return file.Close()
+}
+
+// ExtractBundle extracts the bundle at bundlePath into destDir and checks
+// every member against the size and SHA-256 of the index. It returns the
+// paths of the extracted backups, their sidecars are extracted next to
+// them. Nothing is left in destDir if extraction fails.
+func ExtractBundle(bundlePath, destDir string) ([]string, error) {
+	file, err := os.Open(bundlePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bundle: %w", err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress bundle: %w", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	header, err := tr.Next()
+	if err != nil || header.Name != bundleIndexName {
+		return nil, fmt.Errorf("bundle %q does not start with an index", bundlePath)
+	}
+	var members []BundleMember
+	if err := json.NewDecoder(tr).Decode(&members); err != nil {
+		return nil, fmt.Errorf("failed to read bundle index: %w", err)
+	}
+	expected := make(map[string]BundleMember, len(members))
+	for _, m := range members {
+		// Members are plain filenames, nothing is written outside destDir
+		if m.Name != filepath.Base(m.Name) || m.Name == "." || m.Name == ".." || strings.ContainsRune(m.Name, '\\') {
+			return nil, fmt.Errorf("invalid member name %q in bundle index", m.Name)
+		}
+		expected[m.Name] = m
+	}
+
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory for bundle: %w", err)
+	}
+	var extracted []string
+	removeExtracted := func() {
+		for _, p := range extracted {
+			os.Remove(p)
+		}
+	}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			removeExtracted()
+			return nil, fmt.Errorf("failed to read bundle: %w", err)
+		}
+		m, ok := expected[header.Name]
+		if !ok {
+			removeExtracted()
+			return nil, fmt.Errorf("unexpected member %q in bundle", header.Name)
+		}
+		delete(expected, header.Name)
+
+		destPath := filepath.Join(destDir, m.Name)
+		extracted = append(extracted, destPath)
+		if err := extractBundleMember(tr, destPath, m); err != nil {
+			removeExtracted()
+			return nil, err
+		}
+	}
+	for _, m := range members {
+		if _, missing := expected[m.Name]; missing {
+			removeExtracted()
+			return nil, fmt.Errorf("bundle is missing member %q", m.Name)
+		}
+	}
+
+	var backups []string
+	for _, p := range extracted {
+		if IsBackupFile(filepath.Base(p)) {
+			backups = append(backups, p)
+		}
+	}
+	return backups, nil
+}
+
+// extractBundleMember writes the current bundle member to destPath and
+// checks it against m.
+func extractBundleMember(tr *tar.Reader, destPath string, m BundleMember) error {
+	destFile, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %q: %w", destPath, err)
+	}
+	defer destFile.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(destFile, hash), tr)
+	if err != nil {
+		return fmt.Errorf("failed to extract %q: %w", destPath, err)
+	}
+	if size != m.Size || hex.EncodeToString(hash.Sum(nil)) != m.SHA256 {
+		return fmt.Errorf("bundle member %q does not match the index", m.Name)
+	}
+	return destFile.Close()
+}
+
+// bundleHandler returns a copy of the handler backing up source, one of
+// Config.BundleSources, into the same directory with the same settings.
+// Mirrors, the marker, the log archive and retention concern the run as a
+// whole and are left to the backup of the source.
+func (h *Handler) bundleHandler(source string) *Handler {
+	cfg := *h.cfg
+	cfg.SourcePath = source
+	cfg.BundleSources = nil
+	cfg.MirrorDirs = nil
+	cfg.MarkerPath = ""
+	cfg.LogArchive = ""
+	cfg.KeepLast = nil
+
+	sub := h.withLogger(h.logger.With("bundle_source", source))
+	sub.cfg = &cfg
+	return sub
+}
+
+// backupBundle backs up every Config.BundleSources database and writes
+// them, together with the backup of the source described by manifest,
+// into a bundle next to it. It returns the path of the bundle. The
+// backups are named after startedAt, the start of the run, so every
+// backup of a bundle carries the timestamp of the bundle.
+func (h *Handler) backupBundle(ctx context.Context, runID, reason string, labels map[string]string, startedAt time.Time, manifest *Manifest) (string, error) {
+	backupPaths := []string{filepath.Join(h.cfg.BackupDir, manifest.BackupFile)}
+	for _, source := range h.cfg.BundleSources {
+		m, err := h.bundleHandler(source).backup(ctx, runID, reason, labels, startedAt)
+		if err != nil {
+			return "", fmt.Errorf("failed to back up bundle source %q: %w", source, err)
+		}
+		if m == nil {
+			return "", fmt.Errorf("backup of bundle source %q was skipped", source)
+		}
+		backupPaths = append(backupPaths, filepath.Join(h.cfg.BackupDir, m.BackupFile))
+	}
+
+	name, err := BundleName(manifest.BackupFile)
+	if err != nil {
+		return "", err
+	}
+	bundlePath := filepath.Join(h.cfg.BackupDir, name)
+	if err := h.writeBundle(bundlePath, backupPaths); err != nil {
+		return "", err
+	}
+	if err := h.applyPermissions(bundlePath); err != nil {
+		return "", err
+	}
+	h.logger.Info("Successfully wrote backup bundle", "path", bundlePath, "backups", len(backupPaths))
+	h.mirrorBackup(manifest.Source, bundlePath)
+	return bundlePath, nil
+}
+
+// validateBundleConfig checks Config.BundleSources. Backups are named
+// after the database file, so every source needs a distinct name.
+func (h *Handler) validateBundleConfig() error {
+	if len(h.cfg.BundleSources) == 0 {
+		return nil
+	}
+	if h.cfg.Strategy == StrategyExport {
+		return fmt.Errorf("invalid configuration: bundle_sources is not supported with the export strategy")
+	}
+	seen := map[string]bool{filepath.Base(h.cfg.SourcePath): true}
+	for _, source := range h.cfg.BundleSources {
+		name := filepath.Base(source)
+		if source == "" || seen[name] {
+			return fmt.Errorf("invalid bundle source %q: every database of a bundle needs a distinct file name", source)
+		}
+		seen[name] = true
+	}
+	return nil
+}
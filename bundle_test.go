@@ -0,0 +1,92 @@
+package sqlitebackup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caasmo/restinpieces/db"
+)
+
+func TestHandleWithBundleSources(t *testing.T) {
+	tests := []struct {
+		name string
+		// sources returns the bundle sources, dir holds the source app.db
+		sources func(t *testing.T, dir string) []string
+		wantErr bool
+	}{
+		{
+			name: "distinct names",
+			sources: func(t *testing.T, dir string) []string {
+				path := filepath.Join(dir, "analytics.db")
+				createTestDatabase(t, path)
+				return []string{path}
+			},
+		},
+		{
+			name: "same name as the source",
+			sources: func(t *testing.T, dir string) []string {
+				other := filepath.Join(dir, "other")
+				if err := os.Mkdir(other, 0700); err != nil {
+					t.Fatal(err)
+				}
+				path := filepath.Join(other, "app.db")
+				createTestDatabase(t, path)
+				return []string{path}
+			},
+			wantErr: true,
+		},
+		{
+			name: "same name twice",
+			sources: func(t *testing.T, dir string) []string {
+				path := filepath.Join(dir, "analytics.db")
+				createTestDatabase(t, path)
+				return []string{path, path}
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sourcePath := filepath.Join(dir, "app.db")
+			createTestDatabase(t, sourcePath)
+			backupDir := filepath.Join(dir, "backups")
+			cfg := Config{
+				SourcePath:    sourcePath,
+				BackupDir:     backupDir,
+				Strategy:      StrategyVacuum,
+				Compression:   CompressionGzip,
+				BundleSources: tt.sources(t, dir),
+			}
+
+			err := NewHandler(&cfg, discardLogger()).Handle(context.Background(), db.Job{})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("backup with clashing bundle source names succeeded")
+				}
+				// Nothing is written before the configuration is checked
+				if entries, _ := os.ReadDir(backupDir); len(entries) > 0 {
+					t.Errorf("backup directory not empty after a rejected run: %d entries", len(entries))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			bundles, err := filepath.Glob(filepath.Join(backupDir, "app-*-vacuum"+BundleExtension))
+			if err != nil || len(bundles) != 1 {
+				t.Fatalf("got bundles %q, %v, want one", bundles, err)
+			}
+			backups, err := ExtractBundle(bundles[0], filepath.Join(dir, "extracted"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(backups) != 1+len(cfg.BundleSources) {
+				t.Errorf("got %d backups in the bundle, want %d", len(backups), 1+len(cfg.BundleSources))
+			}
+		})
+	}
+}
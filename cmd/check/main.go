@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	sqlitebackup "github.com/caasmo/restinpieces-sqlite-backup"
+)
+
+// Exit codes of the Nagios plugin API.
+const (
+	exitOK       = 0
+	exitWarning  = 1
+	exitCritical = 2
+	exitUnknown  = 3
+)
+
+func main() {
+	backupDir := flag.String("dir", "", "Directory containing the backup files (required)")
+	database := flag.String("database", "", "Only consider backups of this database, e.g. app for app.db (default: any)")
+	maxAge := flag.Duration("max-age", 25*time.Hour, "CRITICAL if the latest backup is older than this")
+	warnAge := flag.Duration("warn-age", 0, "WARNING if the latest backup is older than this (default: disabled)")
+	inMemory := flag.Bool("in-memory", false, "Verify in memory without writing the decompressed database to disk")
+	ageIdentityPath := flag.String("age-identity", "", "Path to the age identity file decrypting encrypted backups")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -dir <backup-dir> [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Monitoring check: verify the latest backup and assert it is recent enough.\n")
+		fmt.Fprintf(os.Stderr, "Exits 0 (OK), 1 (WARNING), 2 (CRITICAL) or 3 (UNKNOWN) with a one-line status.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if *backupDir == "" || *maxAge <= 0 {
+		flag.Usage()
+		os.Exit(exitUnknown)
+	}
+
+	code, status := check(*backupDir, *database, *maxAge, *warnAge, *inMemory, *ageIdentityPath)
+	fmt.Println(status)
+	os.Exit(code)
+}
+
+// check runs the check and returns the exit code and status line.
+func check(backupDir, database string, maxAge, warnAge time.Duration, inMemory bool, ageIdentityPath string) (int, string) {
+	verifyOpts := sqlitebackup.VerifyOptions{InMemory: inMemory}
+	if ageIdentityPath != "" {
+		var err error
+		verifyOpts.Identities, err = sqlitebackup.LoadIdentities(ageIdentityPath)
+		if err != nil {
+			return exitUnknown, fmt.Sprintf("UNKNOWN - failed to load age identity: %v", err)
+		}
+	}
+
+	files, err := sqlitebackup.ListBackups(backupDir)
+	if err != nil {
+		return exitUnknown, fmt.Sprintf("UNKNOWN - %v", err)
+	}
+	latest, ok := sqlitebackup.LatestBackup(files, database)
+	if !ok {
+		return exitCritical, fmt.Sprintf("CRITICAL - no backups found in %s", backupDir)
+	}
+
+	age := time.Since(latest.Time).Truncate(time.Second)
+	warnThreshold := ""
+	if warnAge > 0 {
+		warnThreshold = fmt.Sprint(int64(warnAge.Seconds()))
+	}
+	perfData := fmt.Sprintf("age=%ds;%s;%d", int64(age.Seconds()), warnThreshold, int64(maxAge.Seconds()))
+
+	if err := sqlitebackup.VerifyBackupWithOptions(context.Background(), filepath.Join(backupDir, latest.Name), verifyOpts); err != nil {
+		return exitCritical, fmt.Sprintf("CRITICAL - latest backup %s failed verification: %v | %s", latest.Name, err, perfData)
+	}
+
+	switch {
+	case age > maxAge:
+		return exitCritical, fmt.Sprintf("CRITICAL - latest backup %s is %s old, max %s | %s", latest.Name, age, maxAge, perfData)
+	case warnAge > 0 && age > warnAge:
+		return exitWarning, fmt.Sprintf("WARNING - latest backup %s is %s old, warn %s | %s", latest.Name, age, warnAge, perfData)
+	}
+	return exitOK, fmt.Sprintf("OK - latest backup %s is %s old and valid | %s", latest.Name, age, perfData)
+}
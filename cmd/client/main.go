@@ -1,33 +1,67 @@
-
 package main
 
 import (
-	"compress/gzip"
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
+	"net"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strings"
 	"time"
 
+	sqlitebackup "github.com/caasmo/restinpieces-sqlite-backup"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
-	"zombiezen.com/go/sqlite"
 )
 
 // Config holds the configuration for the pullfile client.
 type Config struct {
-	SSHUser           string
-	SSHHost           string
-	SSHPort           string
-	SSHPrivateKeyPath string
-	RemoteBackupDir   string
-	LocalBackupDir    string
+	SSHUser              string
+	SSHHost              string
+	SSHPort              string
+	SSHPrivateKeyPath    string
+	RemoteBackupDir      string
+	SourcePath           string // the backed up database, only its backups are pulled, empty for any
+	LocalBackupDir       string
+	InProgressSuffix     string
+	AgeIdentityPath      string                  // decrypts encrypted backups, empty if not encrypted
+	ApplicationID        int32                   // expected PRAGMA application_id, 0 skips the check
+	VerifyReadWrite      bool                    // verify the decompressed copy opened read-write
+	SigningPublicKeyPath string                  // checks the signature of signed backups, empty if not signed
+	ManifestRequired     bool                    // fail on backups without a manifest, e.g. with manifest enabled on the server
+	KeyWrapper           sqlitebackup.KeyWrapper // unwraps the data key of envelope encrypted backups, nil if not used
+	ConnectRetries       int
+	ConnectBackoff       time.Duration
 }
 
 func main() {
+	connectRetries := flag.Int("connect-retries", 3, "Number of retries when the SSH/SFTP connection fails with a network error")
+	connectBackoff := flag.Duration("connect-backoff", 2*time.Second, "Wait before the first connection retry, doubled on each further retry")
+	allowEmpty := flag.Bool("allow-empty", false, "Exit successfully if the remote directory has no backups yet, e.g. right after provisioning")
+	latestValid := flag.Bool("latest-valid", false, "Fall back to older backups, newest first, until one passes verification")
+	bundle := flag.Bool("bundle", false, "Pull the bundle of the latest backup and verify every backup in it")
+	logOpts := sqlitebackup.RegisterLogFlags(flag.CommandLine)
+	flag.Parse()
+
+	logger, err := logOpts.NewLogger(os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
+	if *bundle && *latestValid {
+		slog.Error("The -bundle and -latest-valid flags cannot be combined")
+		os.Exit(1)
+	}
+
 	// Basic configuration. Replace with your actual data.
 	cfg := Config{
 		SSHUser:           "user",
@@ -35,41 +69,116 @@ func main() {
 		SSHPort:           "22",
 		SSHPrivateKeyPath: "/home/user/.ssh/id_rsa",
 		RemoteBackupDir:   "/var/caasmo/backups",
+		SourcePath:        "/var/caasmo/app.db",
 		LocalBackupDir:    "/home/lipo/backups",
+		InProgressSuffix:  sqlitebackup.DefaultInProgressSuffix,
+		ConnectRetries:    *connectRetries,
+		ConnectBackoff:    *connectBackoff,
 	}
 
 	ctx := context.Background()
 	slog.Info("Starting pullfile client")
 
-	sftpClient, err := setupSftpClient(cfg)
+	sftpClient, err := connectWithRetry(cfg)
 	if err != nil {
 		slog.Error("Failed to set up SFTP client", "error", err)
 		os.Exit(1)
 	}
 	defer sftpClient.Close()
 
-	latestBackupFilename, err := findLatestBackup(sftpClient, cfg.RemoteBackupDir)
-	if err != nil {
-		slog.Error("Failed to find latest backup", "error", err)
-		os.Exit(1)
+	verifyOpts := sqlitebackup.VerifyOptions{
+		ExpectedApplicationID: cfg.ApplicationID,
+		ReadWrite:             cfg.VerifyReadWrite,
+	}
+	if cfg.AgeIdentityPath != "" {
+		verifyOpts.Identities, err = sqlitebackup.LoadIdentities(cfg.AgeIdentityPath)
+		if err != nil {
+			slog.Error("Failed to load age identity", "error", err)
+			os.Exit(1)
+		}
+	}
+	if cfg.SigningPublicKeyPath != "" {
+		verifyOpts.SigningPublicKey, err = sqlitebackup.LoadSigningPublicKey(cfg.SigningPublicKeyPath)
+		if err != nil {
+			slog.Error("Failed to load signing public key", "error", err)
+			os.Exit(1)
+		}
 	}
-	slog.Info("Found latest backup file to fetch", "filename", latestBackupFilename)
 
-	localPath, err := downloadBackup(sftpClient, cfg.RemoteBackupDir, latestBackupFilename, cfg.LocalBackupDir)
+	files, err := listRemoteBackups(sftpClient, cfg.RemoteBackupDir, sourceDatabase(cfg.SourcePath), cfg.InProgressSuffix)
+	if errors.Is(err, errNoBackups) && *allowEmpty {
+		slog.Info("No backups found yet, nothing to pull", "dir", cfg.RemoteBackupDir)
+		return
+	}
 	if err != nil {
-		slog.Error("Failed to download backup", "error", err)
+		slog.Error("Failed to find latest backup", "error", err)
 		os.Exit(1)
 	}
-	slog.Info("Successfully downloaded backup", "path", localPath)
 
-	if err := verifyBackup(ctx, localPath); err != nil {
-		slog.Error("Backup verification failed", "error", err)
-		os.Exit(1)
+	var localPath string
+	if *bundle {
+		slog.Info("Found latest backup, fetching its bundle", "filename", files[0].Name)
+		backups, err := pullBundle(ctx, sftpClient, cfg, files[0].Name, verifyOpts)
+		if err != nil {
+			slog.Error("Failed to pull a valid bundle", "error", err)
+			os.Exit(1)
+		}
+		localPath = backups[0]
+	} else if *latestValid {
+		localPath, err = pullLatestValid(ctx, sftpClient, cfg, files, verifyOpts)
+		if err != nil {
+			slog.Error("Failed to pull a valid backup", "error", err)
+			os.Exit(1)
+		}
+	} else {
+		slog.Info("Found latest backup file to fetch", "filename", files[0].Name)
+		localPath, err = fetchBackup(sftpClient, cfg, files[0].Name)
+		if err != nil {
+			slog.Error("Failed to download backup", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Successfully downloaded backup", "path", localPath)
+
+		if err := verifyFetched(ctx, cfg, localPath, verifyOpts); err != nil {
+			slog.Error("Backup verification failed", "error", err)
+			os.Exit(1)
+		}
 	}
 
 	slog.Info("Backup verification successful! The backup is valid.", "path", localPath)
 }
 
+// connectWithRetry sets up the SFTP client, retrying with exponential
+// backoff while the failure is a network error. Authentication and host
+// key failures are returned immediately.
+func connectWithRetry(cfg Config) (*sftp.Client, error) {
+	backoff := cfg.ConnectBackoff
+	for attempt := 0; ; attempt++ {
+		client, err := setupSftpClient(cfg)
+		if err == nil {
+			return client, nil
+		}
+		if attempt >= cfg.ConnectRetries || !isConnectionError(err) {
+			return nil, err
+		}
+
+		slog.Warn("Connection failed, retrying", "attempt", attempt+1, "retries", cfg.ConnectRetries, "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// isConnectionError reports whether err is a transient network failure,
+// as opposed to an authentication or configuration error.
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	// The server closed the connection during the handshake
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
 func setupSftpClient(cfg Config) (*sftp.Client, error) {
 	key, err := os.ReadFile(cfg.SSHPrivateKeyPath)
 	if err != nil {
@@ -98,117 +207,229 @@ func setupSftpClient(cfg Config) (*sftp.Client, error) {
 
 	client, err := sftp.NewClient(conn)
 	if err != nil {
+		conn.Close()
 		return nil, fmt.Errorf("failed to create sftp client: %w", err)
 	}
 
 	return client, nil
 }
 
-// findLatestBackup lists files in the remote directory and returns the name of the most recent one.
-func findLatestBackup(client *sftp.Client, remoteDir string) (string, error) {
-	files, err := client.ReadDir(remoteDir)
+// errNoBackups is returned by listRemoteBackups for a directory without
+// backups.
+var errNoBackups = errors.New("no backup files found")
+
+// sourceDatabase returns the database name in the backup filenames of the
+// database at sourcePath, empty if sourcePath is.
+func sourceDatabase(sourcePath string) string {
+	if sourcePath == "" {
+		return ""
+	}
+	base := filepath.Base(sourcePath)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// listRemoteBackups lists the backups of database in the remote directory,
+// or of every database if it is empty, the most recent first. The
+// directory also holds the backups of bundle sources, written with the
+// same timestamp. Backups are ordered by the parsed filename timestamp,
+// names with a UTC offset do not sort chronologically across DST switches.
+func listRemoteBackups(client *sftp.Client, remoteDir, database, inProgressSuffix string) ([]sqlitebackup.BackupFile, error) {
+	entries, err := client.ReadDir(remoteDir)
 	if err != nil {
-		return "", fmt.Errorf("could not list remote directory: %w", err)
+		return nil, fmt.Errorf("could not list remote directory: %w", err)
+	}
+
+	// Skip sidecars and files still being written
+	var files []sqlitebackup.BackupFile
+	for _, entry := range entries {
+		if !sqlitebackup.IsBackupFile(entry.Name()) || sqlitebackup.IsInProgress(entry.Name(), inProgressSuffix) {
+			continue
+		}
+		bf, err := sqlitebackup.ParseBackupFilename(entry.Name())
+		if err != nil {
+			slog.Warn("Ignoring file with unexpected name", "file", entry.Name(), "error", err)
+			continue
+		}
+		if database != "" && bf.Database != database {
+			continue
+		}
+		files = append(files, bf)
 	}
 
 	sort.Slice(files, func(i, j int) bool {
-		return files[i].Name() > files[j].Name()
+		return files[i].Time.After(files[j].Time)
 	})
 
 	if len(files) == 0 {
-		return "", fmt.Errorf("no backup files found in remote directory: %s", remoteDir)
+		return nil, fmt.Errorf("%w in remote directory: %s", errNoBackups, remoteDir)
 	}
 
-	return files[0].Name(), nil
+	return files, nil
 }
 
-func downloadBackup(client *sftp.Client, remoteDir, filename, localDir string) (string, error) {
-	if err := os.MkdirAll(localDir, 0755); err != nil {
-		return "", fmt.Errorf("could not create local backup directory: %w", err)
+// pullLatestValid downloads and verifies the backups in files, ordered
+// newest first, and returns the local path of the first one passing
+// verification. Backups failing to download or verify are logged,
+// removed locally and skipped.
+func pullLatestValid(ctx context.Context, client *sftp.Client, cfg Config, files []sqlitebackup.BackupFile, opts sqlitebackup.VerifyOptions) (string, error) {
+	for _, f := range files {
+		slog.Info("Fetching backup", "filename", f.Name)
+		localPath, err := fetchBackup(client, cfg, f.Name)
+		if err != nil {
+			slog.Warn("Skipping backup that failed to download", "filename", f.Name, "error", err)
+			removeFetched(filepath.Join(cfg.LocalBackupDir, f.Name))
+			continue
+		}
+		if err := verifyFetched(ctx, cfg, localPath, opts); err != nil {
+			slog.Warn("Skipping backup that failed verification", "filename", f.Name, "error", err)
+			removeFetched(localPath)
+			continue
+		}
+		return localPath, nil
 	}
+	return "", fmt.Errorf("none of the %d backups in %s passed verification", len(files), cfg.RemoteBackupDir)
+}
 
-	remotePath := filepath.Join(remoteDir, filename)
-	localPath := filepath.Join(localDir, filename)
-
-	srcFile, err := client.Open(remotePath)
+// pullBundle downloads the bundle of the backup named filename, extracts
+// it into the local backup directory and verifies every backup in it. It
+// returns the local paths of the backups, the one of filename first.
+func pullBundle(ctx context.Context, client *sftp.Client, cfg Config, filename string, opts sqlitebackup.VerifyOptions) ([]string, error) {
+	name, err := sqlitebackup.BundleName(filename)
 	if err != nil {
-		return "", fmt.Errorf("could not open remote backup file: %w", err)
+		return nil, err
 	}
-	defer srcFile.Close()
-
-	dstFile, err := os.Create(localPath)
+	bundlePath, err := downloadBackup(client, cfg.RemoteBackupDir, name, cfg.LocalBackupDir, cfg.InProgressSuffix)
 	if err != nil {
-		return "", fmt.Errorf("could not create local backup file: %w", err)
+		return nil, fmt.Errorf("failed to download bundle: %w", err)
 	}
-	defer dstFile.Close()
+	slog.Info("Successfully downloaded bundle", "path", bundlePath)
 
-	_, err = io.Copy(dstFile, srcFile)
+	backups, err := sqlitebackup.ExtractBundle(bundlePath, cfg.LocalBackupDir)
 	if err != nil {
-		return "", fmt.Errorf("failed to copy backup file: %w", err)
+		return nil, fmt.Errorf("failed to extract bundle: %w", err)
 	}
-
-	return localPath, nil
+	if len(backups) == 0 {
+		return nil, fmt.Errorf("bundle %s holds no backups", name)
+	}
+	for _, path := range backups {
+		if err := verifyFetched(ctx, cfg, path, opts); err != nil {
+			return nil, fmt.Errorf("verification of %s failed: %w", filepath.Base(path), err)
+		}
+		slog.Info("Verified backup from bundle", "path", path)
+	}
+	return backups, nil
 }
 
-func verifyBackup(ctx context.Context, gzippedBackupPath string) error {
-	tempDBPath := filepath.Join(os.TempDir(), fmt.Sprintf("verified-%d.db", time.Now().UnixNano()))
-	if err := decompressFile(gzippedBackupPath, tempDBPath); err != nil {
-		return fmt.Errorf("failed to decompress for verification: %w", err)
+// fetchBackup downloads the backup named filename, together with its
+// manifest and, if backups are signed, its detached signature, and returns
+// its local path.
+func fetchBackup(client *sftp.Client, cfg Config, filename string) (string, error) {
+	if cfg.SigningPublicKeyPath != "" {
+		if _, err := downloadBackup(client, cfg.RemoteBackupDir, filename+sqlitebackup.SignatureExtension, cfg.LocalBackupDir, cfg.InProgressSuffix); err != nil {
+			return "", fmt.Errorf("failed to download signature: %w", err)
+		}
 	}
-	defer os.Remove(tempDBPath)
+	if err := fetchManifest(client, cfg, filename); err != nil {
+		return "", err
+	}
+	return downloadBackup(client, cfg.RemoteBackupDir, filename, cfg.LocalBackupDir, cfg.InProgressSuffix)
+}
 
-	slog.Info("Decompressed backup for verification", "path", tempDBPath)
+// manifestNames returns the names of the plain and the encrypted manifest
+// of the backup named filename.
+func manifestNames(filename string) []string {
+	name := strings.TrimSuffix(filename, sqlitebackup.EncryptionExtension) + sqlitebackup.ManifestExtension
+	return []string{name, name + sqlitebackup.EncryptionExtension}
+}
 
-	conn, err := sqlite.OpenConn(tempDBPath, sqlite.OpenReadOnly)
-	if err != nil {
-		return fmt.Errorf("failed to open decompressed database: %w", err)
+// fetchManifest downloads the manifest, plain or encrypted, of the backup
+// named filename. The uncompressed size check and the data key of
+// envelope encryption are read from it. A backup without a manifest is
+// only accepted if verification does not need one, see manifestRequired.
+func fetchManifest(client *sftp.Client, cfg Config, filename string) error {
+	for _, name := range manifestNames(filename) {
+		_, err := downloadBackup(client, cfg.RemoteBackupDir, name, cfg.LocalBackupDir, cfg.InProgressSuffix)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to download manifest: %w", err)
+		}
 	}
-	defer conn.Close()
-
-	stmt, err := conn.Prepare("PRAGMA integrity_check;")
-	if err != nil {
-		return fmt.Errorf("failed to prepare integrity_check statement: %w", err)
+	if manifestRequired(cfg) {
+		return fmt.Errorf("backup %s has no manifest", filename)
 	}
-	defer stmt.Finalize()
+	return nil
+}
 
-	row, err := stmt.Step()
-	if err != nil {
-		return fmt.Errorf("failed to execute integrity_check: %w", err)
+// manifestRequired reports whether verification needs the manifest of
+// every backup. Envelope encrypted backups cannot be decrypted without
+// it, and signed backups always have one.
+func manifestRequired(cfg Config) bool {
+	return cfg.ManifestRequired || cfg.KeyWrapper != nil || cfg.SigningPublicKeyPath != ""
+}
+
+// verifyFetched verifies the downloaded backup at localPath, first
+// unwrapping its data key from the manifest if backups are envelope
+// encrypted.
+func verifyFetched(ctx context.Context, cfg Config, localPath string, opts sqlitebackup.VerifyOptions) error {
+	if cfg.KeyWrapper != nil {
+		identity, err := sqlitebackup.UnwrapDataKey(ctx, localPath, cfg.KeyWrapper)
+		if err != nil {
+			return err
+		}
+		opts.Identities = append(slices.Clip(opts.Identities), identity)
 	}
-	if !row {
-		return fmt.Errorf("integrity_check returned no rows")
+	return sqlitebackup.VerifyBackupWithOptions(ctx, localPath, opts)
+}
+
+// removeFetched removes the downloaded backup at localPath together with
+// its signature and manifest.
+func removeFetched(localPath string) {
+	os.Remove(localPath)
+	os.Remove(localPath + sqlitebackup.SignatureExtension)
+	for _, name := range manifestNames(filepath.Base(localPath)) {
+		os.Remove(filepath.Join(filepath.Dir(localPath), name))
 	}
+}
 
-	result := stmt.ColumnText(0)
-	if result != "ok" {
-		return fmt.Errorf("integrity_check failed, result was: %s", result)
+// downloadBackup copies the remote backup to a local in-progress file and
+// renames it into place once complete.
+func downloadBackup(client *sftp.Client, remoteDir, filename, localDir, inProgressSuffix string) (string, error) {
+	if err := os.MkdirAll(localDir, 0755); err != nil {
+		return "", fmt.Errorf("could not create local backup directory: %w", err)
 	}
 
-	return nil
-}
+	remotePath := filepath.Join(remoteDir, filename)
+	localPath := filepath.Join(localDir, filename)
+	partPath := localPath + inProgressSuffix
 
-func decompressFile(sourcePath, destPath string) error {
-	sourceFile, err := os.Open(sourcePath)
+	srcFile, err := client.Open(remotePath)
 	if err != nil {
-		return fmt.Errorf("failed to open source file for decompression: %w", err)
+		return "", fmt.Errorf("could not open remote backup file: %w", err)
 	}
-	defer sourceFile.Close()
+	defer srcFile.Close()
 
-	gzipReader, err := gzip.NewReader(sourceFile)
+	dstFile, err := os.Create(partPath)
 	if err != nil {
-		return fmt.Errorf("failed to create gzip reader: %w", err)
+		return "", fmt.Errorf("could not create local backup file: %w", err)
 	}
-	defer gzipReader.Close()
+	defer dstFile.Close()
 
-	destFile, err := os.Create(destPath)
+	_, err = io.Copy(dstFile, srcFile)
 	if err != nil {
-		return fmt.Errorf("failed to create destination file for decompression: %w", err)
+		os.Remove(partPath)
+		return "", fmt.Errorf("failed to copy backup file: %w", err)
 	}
-	defer destFile.Close()
 
-	if _, err := io.Copy(destFile, gzipReader); err != nil {
-		return fmt.Errorf("failed to copy and decompress data: %w", err)
+	if err := dstFile.Close(); err != nil {
+		os.Remove(partPath)
+		return "", fmt.Errorf("failed to close local backup file: %w", err)
+	}
+	if err := os.Rename(partPath, localPath); err != nil {
+		os.Remove(partPath)
+		return "", fmt.Errorf("failed to rename local backup file into place: %w", err)
 	}
 
-	return nil
+	return localPath, nil
 }
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"testing"
+
+	sqlitebackup "github.com/caasmo/restinpieces-sqlite-backup"
+	"github.com/pkg/sftp"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// createDatabase creates a small database at path.
+func createDatabase(t *testing.T, path string) {
+	t.Helper()
+	conn, err := sqlite.OpenConn(path, sqlite.OpenCreate|sqlite.OpenReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := sqlitex.ExecuteScript(conn, "CREATE TABLE t (x TEXT); INSERT INTO t VALUES ('a'), ('b');", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newPipeClient returns an SFTP client served in-process from the local
+// filesystem.
+func newPipeClient(t *testing.T) *sftp.Client {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	server, err := sftp.NewServer(serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client
+}
+
+func TestPullBundleWithTwoSources(t *testing.T) {
+	dir := t.TempDir()
+	sourcePath := filepath.Join(dir, "app.db")
+	bundleSources := []string{filepath.Join(dir, "analytics.db"), filepath.Join(dir, "audit.db")}
+	for _, path := range append([]string{sourcePath}, bundleSources...) {
+		createDatabase(t, path)
+	}
+
+	remoteDir := filepath.Join(dir, "backups")
+	_, err := sqlitebackup.Backup(context.Background(), sqlitebackup.Options{
+		Config: sqlitebackup.Config{
+			SourcePath:    sourcePath,
+			BackupDir:     remoteDir,
+			Strategy:      sqlitebackup.StrategyVacuum,
+			BundleSources: bundleSources,
+		},
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+
+	client := newPipeClient(t)
+	all, err := listRemoteBackups(client, remoteDir, "", sqlitebackup.DefaultInProgressSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 {
+		t.Fatalf("got %d backups, want 3", len(all))
+	}
+	for _, f := range all {
+		if !f.Time.Equal(all[0].Time) {
+			t.Errorf("backup %s does not share the timestamp of the run %v", f.Name, all[0].Time)
+		}
+	}
+
+	files, err := listRemoteBackups(client, remoteDir, sourceDatabase(sourcePath), sqlitebackup.DefaultInProgressSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files[0].Database != "app" {
+		t.Fatalf("latest backup is of database %q, want app", files[0].Database)
+	}
+
+	cfg := Config{
+		RemoteBackupDir:  remoteDir,
+		LocalBackupDir:   filepath.Join(dir, "local"),
+		InProgressSuffix: sqlitebackup.DefaultInProgressSuffix,
+	}
+	backups, err := pullBundle(context.Background(), client, cfg, files[0].Name, sqlitebackup.VerifyOptions{})
+	if err != nil {
+		t.Fatalf("pull bundle failed: %v", err)
+	}
+	if len(backups) != 3 {
+		t.Fatalf("bundle holds %d backups, want 3", len(backups))
+	}
+	if got := filepath.Base(backups[0]); got != files[0].Name {
+		t.Errorf("first backup of the bundle is %s, want %s", got, files[0].Name)
+	}
+}
+
+func TestFetchBackupManifest(t *testing.T) {
+	tests := []struct {
+		name             string
+		manifest         bool
+		manifestRequired bool
+		wantErr          bool
+	}{
+		{"manifest", true, true, false},
+		{"no manifest", false, false, false},
+		{"required manifest missing", false, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sourcePath := filepath.Join(dir, "app.db")
+			createDatabase(t, sourcePath)
+			remoteDir := filepath.Join(dir, "backups")
+			result, err := sqlitebackup.Backup(context.Background(), sqlitebackup.Options{
+				Config: sqlitebackup.Config{
+					SourcePath: sourcePath,
+					BackupDir:  remoteDir,
+					Strategy:   sqlitebackup.StrategyVacuum,
+					Manifest:   tt.manifest,
+				},
+				Reason: sqlitebackup.ReasonScheduled,
+				Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+			})
+			if err != nil {
+				t.Fatalf("backup failed: %v", err)
+			}
+
+			cfg := Config{
+				RemoteBackupDir:  remoteDir,
+				LocalBackupDir:   filepath.Join(dir, "local"),
+				InProgressSuffix: sqlitebackup.DefaultInProgressSuffix,
+				ManifestRequired: tt.manifestRequired,
+			}
+			localPath, err := fetchBackup(newPipeClient(t), cfg, filepath.Base(result.Path))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("fetch succeeded without the required manifest")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fetch failed: %v", err)
+			}
+			_, err = sqlitebackup.ReadManifest(localPath)
+			if tt.manifest && err != nil {
+				t.Errorf("manifest was not downloaded: %v", err)
+			}
+			if !tt.manifest && err == nil {
+				t.Error("found a manifest for a backup without one")
+			}
+			if err := verifyFetched(context.Background(), cfg, localPath, sqlitebackup.VerifyOptions{}); err != nil {
+				t.Errorf("verification failed: %v", err)
+			}
+		})
+	}
+}
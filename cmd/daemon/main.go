@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	sqlitebackup "github.com/caasmo/restinpieces-sqlite-backup"
+	"github.com/caasmo/restinpieces/db"
+)
+
+func main() {
+	logOpts := sqlitebackup.RegisterLogFlags(flag.CommandLine)
+
+	configPath := flag.String("config", "", "Path to the backup TOML configuration file (required)")
+	interval := flag.Duration("interval", 24*time.Hour, "Interval between backups (e.g., '24h', '1h30m')")
+	timeout := flag.Duration("timeout", 0, "Maximum duration of a single backup run, 0 for no limit")
+	runNow := flag.Bool("run-now", true, "Run a backup immediately at startup instead of waiting for the first interval")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -config <config-path> [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Run SQLite backups periodically without the restinpieces job scheduler.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	logger, err := logOpts.NewLogger(os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *configPath == "" || *interval <= 0 || *timeout < 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	rawConfig, err := os.ReadFile(*configPath)
+	if err != nil {
+		logger.Error("failed to read backup config file", "path", *configPath, "error", err)
+		os.Exit(1)
+	}
+
+	backupCfg, warnings, err := sqlitebackup.MigrateConfig(rawConfig)
+	if err != nil {
+		logger.Error("failed to unmarshal backup TOML config", "path", *configPath, "error", err)
+		os.Exit(1)
+	}
+	for _, warning := range warnings {
+		logger.Warn("backup config needs upgrade", "path", *configPath, "warning", warning)
+	}
+
+	handler := sqlitebackup.NewHandler(&backupCfg, logger)
+
+	// SIGINT and SIGTERM cancel the context: an ongoing online backup is
+	// aborted between steps and no new backup is started.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	runBackup := func() {
+		runCtx := ctx
+		if *timeout > 0 {
+			var cancel context.CancelFunc
+			runCtx, cancel = context.WithTimeout(ctx, *timeout)
+			defer cancel()
+		}
+		if err := handler.Handle(runCtx, db.Job{}); err != nil {
+			logger.Error("backup failed", "error", err)
+		}
+	}
+
+	logger.Info("Starting backup daemon", "source", backupCfg.SourcePath, "interval", *interval)
+
+	if *runNow {
+		runBackup()
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("Backup daemon shut down gracefully.")
+			return
+		case <-ticker.C:
+			runBackup()
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"filippo.io/age"
+	sqlitebackup "github.com/caasmo/restinpieces-sqlite-backup"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// SchemaObject is a table, index, view or trigger of a database.
+type SchemaObject struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// TableDelta is the row count difference of a table present in both backups.
+type TableDelta struct {
+	Name  string `json:"name"`
+	RowsA int64  `json:"rows_a"`
+	RowsB int64  `json:"rows_b"`
+	Delta int64  `json:"delta"`
+}
+
+// Report is the machine-readable difference between backup A and B.
+type Report struct {
+	BackupA string         `json:"backup_a"`
+	BackupB string         `json:"backup_b"`
+	Added   []SchemaObject `json:"added"`
+	Removed []SchemaObject `json:"removed"`
+	Changed []SchemaObject `json:"changed"`
+	Tables  []TableDelta   `json:"tables"`
+}
+
+func main() {
+	logOpts := sqlitebackup.RegisterLogFlags(flag.CommandLine)
+
+	ageIdentityPath := flag.String("age-identity", "", "Path to the age identity file decrypting encrypted backups")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <backupA> <backupB>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Compare two backups and print schema and row count differences as JSON.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	logger, err := logOpts.NewLogger(os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var identities []age.Identity
+	if *ageIdentityPath != "" {
+		var err error
+		identities, err = sqlitebackup.LoadIdentities(*ageIdentityPath)
+		if err != nil {
+			logger.Error("Failed to load age identity", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	report, err := diffBackups(flag.Arg(0), flag.Arg(1), identities)
+	if err != nil {
+		logger.Error("Failed to compare backups", "error", err)
+		os.Exit(1)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		logger.Error("Failed to write report", "error", err)
+		os.Exit(1)
+	}
+}
+
+// diffBackups opens both backups and compares their schema and row
+// counts.
+func diffBackups(backupA, backupB string, identities []age.Identity) (*Report, error) {
+	opts := sqlitebackup.OpenOptions{Identities: identities}
+	connA, cleanupA, err := sqlitebackup.OpenBackup(backupA, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %q: %w", backupA, err)
+	}
+	defer cleanupA()
+
+	connB, cleanupB, err := sqlitebackup.OpenBackup(backupB, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %q: %w", backupB, err)
+	}
+	defer cleanupB()
+
+	schemaA, err := readSchema(connA)
+	if err != nil {
+		return nil, err
+	}
+	schemaB, err := readSchema(connB)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		BackupA: backupA,
+		BackupB: backupB,
+		Added:   []SchemaObject{},
+		Removed: []SchemaObject{},
+		Changed: []SchemaObject{},
+		Tables:  []TableDelta{},
+	}
+
+	for _, key := range sortedKeys(schemaA) {
+		sqlB, ok := schemaB[key]
+		switch {
+		case !ok:
+			report.Removed = append(report.Removed, key)
+		case sqlB != schemaA[key]:
+			report.Changed = append(report.Changed, key)
+		}
+	}
+	for _, key := range sortedKeys(schemaB) {
+		if _, ok := schemaA[key]; !ok {
+			report.Added = append(report.Added, key)
+		}
+	}
+
+	for _, key := range sortedKeys(schemaA) {
+		if _, ok := schemaB[key]; !ok || key.Type != "table" {
+			continue
+		}
+		rowsA, err := countRows(connA, key.Name)
+		if err != nil {
+			return nil, err
+		}
+		rowsB, err := countRows(connB, key.Name)
+		if err != nil {
+			return nil, err
+		}
+		if rowsA != rowsB {
+			report.Tables = append(report.Tables, TableDelta{Name: key.Name, RowsA: rowsA, RowsB: rowsB, Delta: rowsB - rowsA})
+		}
+	}
+
+	return report, nil
+}
+
+// readSchema returns the sql of every user schema object of a database.
+func readSchema(conn *sqlite.Conn) (map[SchemaObject]string, error) {
+	objects := make(map[SchemaObject]string)
+	query := "SELECT type, name, ifnull(sql, '') FROM sqlite_master WHERE name NOT LIKE 'sqlite_%';"
+	err := sqlitex.ExecuteTransient(conn, query, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			objects[SchemaObject{Type: stmt.ColumnText(0), Name: stmt.ColumnText(1)}] = stmt.ColumnText(2)
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema: %w", err)
+	}
+	return objects, nil
+}
+
+// countRows counts the rows of a table.
+func countRows(conn *sqlite.Conn, table string) (int64, error) {
+	query := fmt.Sprintf(`SELECT count(*) FROM "%s";`, strings.ReplaceAll(table, `"`, `""`))
+	var count int64
+	err := sqlitex.ExecuteTransient(conn, query, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			count = stmt.ColumnInt64(0)
+			return nil
+		},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count rows of %s: %w", table, err)
+	}
+	return count, nil
+}
+
+// sortedKeys returns the schema objects ordered by type and name.
+func sortedKeys(objects map[SchemaObject]string) []SchemaObject {
+	keys := make([]SchemaObject, 0, len(objects))
+	for key := range objects {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Type != keys[j].Type {
+			return keys[i].Type < keys[j].Type
+		}
+		return keys[i].Name < keys[j].Name
+	})
+	return keys
+}
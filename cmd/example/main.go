@@ -3,7 +3,6 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log/slog"
 	"os"
 
 	"github.com/caasmo/restinpieces"
@@ -11,17 +10,18 @@ import (
 	"github.com/pelletier/go-toml/v2"
 )
 
-const JobTypeDbBackup = "db_backup"
-
 func main() {
-	// Create a simple slog text logger that outputs to stdout
-	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	logOpts := sqlitebackup.RegisterLogFlags(flag.CommandLine)
 
 	dbPath := flag.String("dbpath", "", "Path to the SQLite DB")
 	ageKeyPath := flag.String("age-key", "", "Path to the age identity (private key) file (required)")
+	statusPath := flag.String("status-path", "/backup/status", "HTTP path serving the backup status as JSON, empty to disable")
+	allowedSourceDir := flag.String("allowed-source-dir", "", "Only back up databases within this directory, whatever the stored config says (default: no restriction)")
+	printConfig := flag.Bool("print-config", false, "Print the effective DB backup config as TOML after migration and defaults, validate it and exit")
+	configPath := flag.String("config", "", "Path to a plain TOML backup config file, used instead of the secure config store (for local development)")
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s -db <db-path> -age-key <id-path>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s -dbpath <db-path> -age-key <id-path> [-config <toml-path>]\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Start the restinpieces application server with SQLite backup support.\n\n")
 		fmt.Fprintf(os.Stderr, "Flags:\n")
 		flag.PrintDefaults()
@@ -29,6 +29,12 @@ func main() {
 
 	flag.Parse()
 
+	logger, err := logOpts.NewLogger(os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	if *dbPath == "" || *ageKeyPath == "" {
 		flag.Usage()
 		os.Exit(1)
@@ -59,39 +65,91 @@ func main() {
 	}
 	logger = app.Logger()
 
-	// --- Load DB Backup Config from SecureConfigStore ---
-	logger.Info("Loading DB backup configuration from database", "scope", sqlitebackup.ScopeDbBackup)
-	encryptedTomlData, format, err := app.ConfigStore().Get(sqlitebackup.ScopeDbBackup, 0)
-	if err != nil {
-		logger.Error("failed to load DB backup config from DB", "scope", sqlitebackup.ScopeDbBackup, "error", err)
-		os.Exit(1)
-	}
-	if len(encryptedTomlData) == 0 {
-		logger.Error("DB backup config data loaded from DB is empty", "scope", sqlitebackup.ScopeDbBackup)
-		os.Exit(1)
-	}
+	// --- Load DB Backup Config ---
+	// Exactly one source is used: the plain TOML file if -config is given,
+	// the SecureConfigStore otherwise.
+	var tomlData []byte
+	configSource := "secure_store"
+	if *configPath != "" {
+		configSource = "file"
+		logger.Info("Loading DB backup configuration from file, the secure store is not consulted", "path", *configPath)
+		tomlData, err = os.ReadFile(*configPath)
+		if err != nil {
+			logger.Error("failed to read DB backup config file", "path", *configPath, "error", err)
+			os.Exit(1)
+		}
+		if len(tomlData) == 0 {
+			logger.Error("DB backup config file is empty", "path", *configPath)
+			os.Exit(1)
+		}
+	} else {
+		logger.Info("Loading DB backup configuration from database", "scope", sqlitebackup.ScopeDbBackup)
+		var format string
+		tomlData, format, err = app.ConfigStore().Get(sqlitebackup.ScopeDbBackup, 0)
+		if err != nil {
+			logger.Error("failed to load DB backup config from DB", "scope", sqlitebackup.ScopeDbBackup, "error", err)
+			os.Exit(1)
+		}
+		if len(tomlData) == 0 {
+			logger.Error("DB backup config data loaded from DB is empty", "scope", sqlitebackup.ScopeDbBackup)
+			os.Exit(1)
+		}
 
-	// Check if the format is TOML before unmarshalling
-	if format != "toml" {
-		logger.Error("DB backup config data is not in TOML format", "scope", sqlitebackup.ScopeDbBackup, "expected_format", "toml", "actual_format", format)
-		os.Exit(1)
+		// Check if the format is TOML before unmarshalling
+		if format != "toml" {
+			logger.Error("DB backup config data is not in TOML format", "scope", sqlitebackup.ScopeDbBackup, "expected_format", "toml", "actual_format", format)
+			os.Exit(1)
+		}
 	}
 
-	var backupCfg sqlitebackup.Config // Declare variable to hold the config
-	if err := toml.Unmarshal(encryptedTomlData, &backupCfg); err != nil {
-		logger.Error("failed to unmarshal DB backup TOML config", "scope", sqlitebackup.ScopeDbBackup, "error", err)
+	// Migrate configs stored by older releases to the current layout
+	backupCfg, warnings, err := sqlitebackup.MigrateConfig(tomlData)
+	if err != nil {
+		logger.Error("failed to unmarshal DB backup TOML config", "source", configSource, "error", err)
 		os.Exit(1)
 	}
-	logger.Info("Successfully unmarshalled DB backup config", "scope", sqlitebackup.ScopeDbBackup)
+	for _, warning := range warnings {
+		logger.Warn("DB backup config needs upgrade", "source", configSource, "warning", warning)
+	}
+	logger.Info("Successfully unmarshalled DB backup config", "source", configSource)
+
+	if *printConfig {
+		// The config holds no secrets: age recipients and the KMS key id
+		// are public identifiers, identities are never part of it
+		out, err := toml.Marshal(backupCfg)
+		if err != nil {
+			logger.Error("failed to encode DB backup config", "error", err)
+			os.Exit(1)
+		}
+		fmt.Printf("# Effective DB backup config, source: %s\n%s", configSource, out)
+		if err := sqlitebackup.NewHandler(&backupCfg, logger).Validate(); err != nil {
+			logger.Error("DB backup config is invalid", "source", configSource, "error", err)
+			os.Exit(1)
+		}
+		logger.Info("DB backup config is valid", "source", configSource)
+		return
+	}
 
 	// --- Create and Register Backup Handler ---
 	dbBackupHandler := sqlitebackup.NewHandler(&backupCfg, logger)
-	err = srv.AddJobHandler(JobTypeDbBackup, dbBackupHandler)
+	if *allowedSourceDir != "" {
+		if err := dbBackupHandler.RestrictSourcePaths(*allowedSourceDir); err != nil {
+			logger.Error("Failed to restrict backup source paths", "error", err)
+			os.Exit(1)
+		}
+	}
+	err = srv.AddJobHandler(sqlitebackup.JobTypeDbBackup, dbBackupHandler)
 	if err != nil {
-		logger.Error("Failed to register database backup job handler", "job_type", JobTypeDbBackup, "error", err)
+		logger.Error("Failed to register database backup job handler", "job_type", sqlitebackup.JobTypeDbBackup, "error", err)
 		os.Exit(1)
 	}
-	logger.Info("Registered database backup job handler", "job_type", JobTypeDbBackup)
+	logger.Info("Registered database backup job handler", "job_type", sqlitebackup.JobTypeDbBackup)
+
+	// --- Expose Backup Status for Monitoring ---
+	if *statusPath != "" {
+		app.Router().Handle("GET "+*statusPath, dbBackupHandler.StatusHandler())
+		logger.Info("Serving backup status", "path", *statusPath)
+	}
 
 	srv.Run()
 
@@ -1,26 +1,32 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
-	"log/slog"
 	"os"
 
 	sqlitebackup "github.com/caasmo/restinpieces-sqlite-backup"
 	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	FormatTOML = "toml"
+	FormatJSON = "json"
+	FormatYAML = "yaml"
 )
 
 func main() {
-	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-		Level: slog.LevelInfo,
-	}))
+	logOpts := sqlitebackup.RegisterLogFlags(flag.CommandLine)
 
-	outputFileFlag := flag.String("output", "backup.blueprint.toml", "Output file path for the blueprint TOML configuration")
-	flag.StringVar(outputFileFlag, "o", "backup.blueprint.toml", "Output file path (shorthand)")
+	outputFileFlag := flag.String("output", "", "Output file path for the blueprint configuration (default \"backup.blueprint.<format>\")")
+	flag.StringVar(outputFileFlag, "o", "", "Output file path (shorthand)")
+	formatFlag := flag.String("format", FormatTOML, "Output format of the blueprint configuration: toml, json or yaml")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Generates a blueprint backup TOML configuration file with example values.\n")
+		fmt.Fprintf(os.Stderr, "Generates a blueprint backup configuration file with example values.\n")
 		fmt.Fprintf(os.Stderr, "Remember to replace placeholder values.\n")
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
@@ -28,22 +34,50 @@ func main() {
 
 	flag.Parse()
 
+	logger, err := logOpts.NewLogger(os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *outputFileFlag == "" {
+		*outputFileFlag = "backup.blueprint." + *formatFlag
+	}
+
 	logger.Info("Generating backup blueprint configuration...")
 	blueprintCfg := sqlitebackup.GenerateBlueprintConfig()
 
-	logger.Info("Marshalling configuration to TOML...")
-	tomlBytes, err := toml.Marshal(blueprintCfg)
+	logger.Info("Marshalling configuration...", "format", *formatFlag)
+	cfgBytes, err := marshal(*formatFlag, blueprintCfg)
 	if err != nil {
-		logger.Error("Failed to marshal blueprint config to TOML", "error", err)
+		logger.Error("Failed to marshal blueprint config", "format", *formatFlag, "error", err)
 		os.Exit(1)
 	}
 
 	logger.Info("Writing blueprint configuration", "path", *outputFileFlag)
-	err = os.WriteFile(*outputFileFlag, tomlBytes, 0644)
+	err = os.WriteFile(*outputFileFlag, cfgBytes, 0644)
 	if err != nil {
 		logger.Error("Failed to write blueprint file", "path", *outputFileFlag, "error", err)
 		os.Exit(1)
 	}
 
 	logger.Info("Successfully created blueprint configuration file", "path", *outputFileFlag)
-}
\ No newline at end of file
+}
+
+// marshal encodes the config using the encoder selected by format.
+func marshal(format string, cfg sqlitebackup.Config) ([]byte, error) {
+	switch format {
+	case FormatTOML:
+		return toml.Marshal(cfg)
+	case FormatJSON:
+		b, err := json.MarshalIndent(cfg, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(b, '\n'), nil
+	case FormatYAML:
+		return yaml.Marshal(cfg)
+	default:
+		return nil, fmt.Errorf("unknown format: %q (expected toml, json or yaml)", format)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+
+	sqlitebackup "github.com/caasmo/restinpieces-sqlite-backup"
+)
+
+func TestBlueprintIsValidAfterMigration(t *testing.T) {
+	raw, err := marshal(FormatTOML, sqlitebackup.GenerateBlueprintConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, warnings, err := sqlitebackup.MigrateConfig(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) > 0 {
+		t.Errorf("a fresh blueprint needs no upgrade, got warnings %q", warnings)
+	}
+	h := sqlitebackup.NewHandler(&cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err := h.Validate(); err != nil {
+		t.Errorf("migrated blueprint is invalid: %v", err)
+	}
+}
+
+func TestBlueprintOmitsDeprecatedKeys(t *testing.T) {
+	for _, format := range []string{FormatTOML, FormatJSON, FormatYAML} {
+		t.Run(format, func(t *testing.T) {
+			raw, err := marshal(format, sqlitebackup.GenerateBlueprintConfig())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range strings.Split(string(raw), "\n") {
+				if strings.Contains(line, "age_recipient") && !strings.Contains(line, "age_recipients") {
+					t.Errorf("blueprint contains deprecated key: %s", line)
+				}
+			}
+		})
+	}
+}
@@ -1,40 +1,51 @@
-
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
-	"log/slog"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/caasmo/restinpieces"
-	"github.com/caasmo/restinpieces/db"
+	sqlitebackup "github.com/caasmo/restinpieces-sqlite-backup"
 	"github.com/caasmo/restinpieces/db/zombiezen"
 )
 
-const JobTypeDbBackup = "db_backup"
-
 func main() {
-	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	logOpts := sqlitebackup.RegisterLogFlags(flag.CommandLine)
 
 	dbPath := flag.String("dbpath", "", "Path to the SQLite DB file (required)")
 	interval := flag.String("interval", "", "Interval for the recurrent backup job (e.g., '24h', '1h30m') (required)")
 	scheduledStr := flag.String("scheduled", "", "Start time for the job in RFC3339 format (e.g., '2025-07-01T10:00:00Z') (required)")
+	once := flag.Bool("once", false, "Insert a one-off backup job instead of a recurrent one, -interval is not needed")
+	scope := flag.String("scope", "", "Config scope of the backup, for applications running several backup configs with sqlitebackup.ScopeRouter (default "+sqlitebackup.ScopeDbBackup+")")
+	reason := flag.String("reason", "", "Why the backup runs, stored in the manifest and logs, e.g. "+sqlitebackup.ReasonPreMigration+" (default "+sqlitebackup.ReasonScheduled+")")
+	labels := labelFlag{}
+	flag.Var(labels, "label", "Label stored in the backup manifest as key=value, e.g. release=v2.3.1 (repeatable)")
 	flag.Parse()
 
-	if *dbPath == "" || *interval == "" || *scheduledStr == "" {
-		fmt.Fprintln(os.Stderr, "Error: -dbpath, -interval, and -scheduled are required")
+	logger, err := logOpts.NewLogger(os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *dbPath == "" || (*interval == "" && !*once) || *scheduledStr == "" {
+		fmt.Fprintln(os.Stderr, "Error: -dbpath, -interval (unless -once), and -scheduled are required")
 		flag.Usage()
 		os.Exit(1)
 	}
 
 	// Parse the interval string into a time.Duration
-	intervalDuration, err := time.ParseDuration(*interval)
-	if err != nil {
-		logger.Error("Invalid interval format", "error", err)
-		os.Exit(1)
+	var intervalDuration time.Duration
+	if !*once {
+		var err error
+		intervalDuration, err = time.ParseDuration(*interval)
+		if err != nil {
+			logger.Error("Invalid interval format", "error", err)
+			os.Exit(1)
+		}
 	}
 
 	// Parse the scheduledFor string into a time.Time
@@ -61,29 +72,29 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Define the recurrent job
-	// No payload is needed for this job type
-	payload, err := json.Marshal(struct{}{})
-	if err != nil {
-		logger.Error("Failed to marshal empty payload", "error", err)
-		os.Exit(1)
-	}
-
-	newJob := db.Job{
-		JobType:      JobTypeDbBackup,
-		Payload:      payload,
-		ScheduledFor: scheduledTime, // Use the time from the flag
-		Recurrent:    true,
-		Interval:     intervalDuration,
-	}
+	logger.Info("Inserting backup job into database", "type", sqlitebackup.JobTypeDbBackup, "recurrent", !*once, "interval", intervalDuration, "scheduled_for", scheduledTime, "reason", *reason, "labels", map[string]string(labels), "scope", *scope)
 
-	logger.Info("Inserting recurrent backup job into database", "type", newJob.JobType, "interval", newJob.Interval, "scheduled_for", newJob.ScheduledFor)
-
-	// Insert the job using the DbQueue interface
-	if err := dbConn.InsertJob(newJob); err != nil {
+	payload := sqlitebackup.JobPayload{Reason: *reason, Labels: labels, Scope: *scope}
+	if err := sqlitebackup.ScheduleBackupJobWithPayload(dbConn, intervalDuration, scheduledTime, !*once, payload); err != nil {
 		logger.Error("Failed to insert job", "error", err)
 		os.Exit(1)
 	}
 
 	logger.Info("Successfully inserted backup job. The server will pick it up on its next cycle.")
 }
+
+// labelFlag collects repeated -label key=value flags.
+type labelFlag map[string]string
+
+func (l labelFlag) String() string {
+	return fmt.Sprint(map[string]string(l))
+}
+
+func (l labelFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("label must be key=value, got %q", value)
+	}
+	l[key] = val
+	return nil
+}
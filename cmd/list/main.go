@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"filippo.io/age"
+	sqlitebackup "github.com/caasmo/restinpieces-sqlite-backup"
+)
+
+func main() {
+	logOpts := sqlitebackup.RegisterLogFlags(flag.CommandLine)
+
+	backupDir := flag.String("dir", "", "Directory containing the backup files (required)")
+	database := flag.String("database", "", "Only list backups of this database, e.g. app for app.db (default: any)")
+	ageIdentityPath := flag.String("age-identity", "", "Path to the age identity file decrypting encrypted manifests")
+	filter := labelFlag{}
+	flag.Var(filter, "label", "Only list backups with this label, as key=value (repeatable)")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -dir <backup-dir> [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "List backups, newest first, with the labels from their manifests.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	logger, err := logOpts.NewLogger(os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *backupDir == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var identities []age.Identity
+	if *ageIdentityPath != "" {
+		var err error
+		identities, err = sqlitebackup.LoadIdentities(*ageIdentityPath)
+		if err != nil {
+			logger.Error("Failed to load age identity", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	files, err := sqlitebackup.ListBackups(*backupDir)
+	if err != nil {
+		logger.Error("Failed to list backups", "dir", *backupDir, "error", err)
+		os.Exit(1)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Time.After(files[j].Time)
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "BACKUP\tCREATED\tSTRATEGY\tSIZE\tREASON\tLABELS")
+	for _, f := range files {
+		if *database != "" && f.Database != *database {
+			continue
+		}
+
+		// Backups without a manifest have no reason or labels
+		var reason string
+		var labels map[string]string
+		var size int64
+		if manifest, err := sqlitebackup.ReadManifest(filepath.Join(*backupDir, f.Name), identities...); err == nil {
+			reason, labels, size = manifest.Reason, manifest.Labels, manifest.Size
+		} else if info, err := os.Stat(filepath.Join(*backupDir, f.Name)); err == nil {
+			size = info.Size()
+		}
+
+		if !matches(labels, filter) {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", f.Name, f.Time.Format(time.RFC3339), f.Strategy, size, reason, formatLabels(labels))
+	}
+	w.Flush()
+}
+
+// matches reports whether labels contains every label of filter.
+func matches(labels, filter map[string]string) bool {
+	for key, value := range filter {
+		if got, ok := labels[key]; !ok || got != value {
+			return false
+		}
+	}
+	return true
+}
+
+// formatLabels formats labels as sorted key=value pairs.
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// labelFlag collects repeated -label key=value flags.
+type labelFlag map[string]string
+
+func (l labelFlag) String() string {
+	return fmt.Sprint(map[string]string(l))
+}
+
+func (l labelFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("label must be key=value, got %q", value)
+	}
+	l[key] = val
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	sqlitebackup "github.com/caasmo/restinpieces-sqlite-backup"
+)
+
+func main() {
+	logOpts := sqlitebackup.RegisterLogFlags(flag.CommandLine)
+
+	archivePath := flag.String("archive", "", "Path to the log archive (required)")
+	appendPath := flag.String("append", "", "Append this backup file to the archive, named by its filename")
+	list := flag.Bool("list", false, "List the backups in the archive")
+	extract := flag.String("extract", "", "Name of the backup to extract, the newest one if the name was appended more than once")
+	outPath := flag.String("out", "", "Where -extract writes the backup (default: its name in the current directory)")
+	check := flag.Bool("check", false, "Verify the checksum of every record and the index of the whole archive")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -archive <path> (-append <file> | -list | -extract <name> [-out <path>] | -check)\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Append backups to, list, extract from, or check an append-only log archive.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	logger, err := logOpts.NewLogger(os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	actions := 0
+	for _, set := range []bool{*appendPath != "", *list, *extract != "", *check} {
+		if set {
+			actions++
+		}
+	}
+	if *archivePath == "" || actions != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	switch {
+	case *appendPath != "":
+		f, err := os.Open(*appendPath)
+		if err != nil {
+			logger.Error("Failed to open backup", "path", *appendPath, "error", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		entry, err := sqlitebackup.AppendToLogArchive(*archivePath, filepath.Base(*appendPath), f)
+		if err != nil {
+			logger.Error("Failed to append backup", "archive", *archivePath, "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Appended backup", "archive", *archivePath, "name", entry.Name, "size", entry.Size, "sha256", entry.SHA256)
+
+	case *list:
+		entries, err := sqlitebackup.ListLogArchive(*archivePath)
+		if err != nil {
+			logger.Error("Failed to list log archive", "archive", *archivePath, "error", err)
+			os.Exit(1)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tSIZE\tADDED\tSHA256")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", e.Name, e.Size, e.AddedAt.Format("2006-01-02T15:04:05Z"), e.SHA256)
+		}
+		w.Flush()
+
+	case *extract != "":
+		dest := *outPath
+		if dest == "" {
+			dest = filepath.Base(*extract)
+		}
+		out, err := os.Create(dest)
+		if err != nil {
+			logger.Error("Failed to create output file", "path", dest, "error", err)
+			os.Exit(1)
+		}
+		defer out.Close()
+		if err := sqlitebackup.ExtractFromLogArchive(*archivePath, *extract, out); err != nil {
+			out.Close()
+			os.Remove(dest)
+			logger.Error("Failed to extract backup", "archive", *archivePath, "name", *extract, "error", err)
+			os.Exit(1)
+		}
+		if err := out.Close(); err != nil {
+			logger.Error("Failed to close output file", "path", dest, "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Extracted backup", "name", *extract, "path", dest)
+
+	case *check:
+		if err := sqlitebackup.CheckLogArchive(*archivePath); err != nil {
+			logger.Error("Log archive check failed", "archive", *archivePath, "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Log archive is intact", "archive", *archivePath)
+	}
+}
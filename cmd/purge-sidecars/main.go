@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	sqlitebackup "github.com/caasmo/restinpieces-sqlite-backup"
+)
+
+func main() {
+	logOpts := sqlitebackup.RegisterLogFlags(flag.CommandLine)
+
+	backupDir := flag.String("dir", "", "Directory containing the backup files (required)")
+	remove := flag.Bool("delete", false, "Delete the orphaned sidecars instead of only reporting them")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -dir <backup-dir> [-delete]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Report sidecar files whose backup file is missing, and optionally delete them.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	logger, err := logOpts.NewLogger(os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *backupDir == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	orphans, err := sqlitebackup.OrphanedSidecars(*backupDir)
+	if err != nil {
+		logger.Error("Failed to find orphaned sidecars", "dir", *backupDir, "error", err)
+		os.Exit(1)
+	}
+
+	var failed int
+	for _, path := range orphans {
+		if !*remove {
+			logger.Info("Orphaned sidecar", "path", path)
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			logger.Error("Failed to delete orphaned sidecar", "path", path, "error", err)
+			failed++
+			continue
+		}
+		logger.Info("Deleted orphaned sidecar", "path", path)
+	}
+
+	logger.Info("Orphaned sidecar scan finished", "orphans", len(orphans), "deleted", *remove, "failed", failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	sqlitebackup "github.com/caasmo/restinpieces-sqlite-backup"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func main() {
+	logOpts := sqlitebackup.RegisterLogFlags(flag.CommandLine)
+
+	backupDir := flag.String("dir", "", "Directory containing the backup files (required)")
+	database := flag.String("database", "", "Only consider backups of this database, e.g. app for app.db (default: any)")
+	queriesPath := flag.String("queries", "", "File with one validation query per line, each must return a true first column")
+	tempDir := flag.String("temp-dir", "", "Directory for the restored database (default: system temp dir)")
+	ageIdentityPath := flag.String("age-identity", "", "Path to the age identity file decrypting encrypted backups")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -dir <backup-dir> [-queries <file>] [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Restore the latest backup to a temporary database and run validation queries against it.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	logger, err := logOpts.NewLogger(os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *backupDir == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var queries []string
+	if *queriesPath != "" {
+		var err error
+		queries, err = readQueries(*queriesPath)
+		if err != nil {
+			logger.Error("Failed to read validation queries", "path", *queriesPath, "error", err)
+			os.Exit(1)
+		}
+	}
+
+	files, err := sqlitebackup.ListBackups(*backupDir)
+	if err != nil {
+		logger.Error("Failed to find latest backup", "dir", *backupDir, "error", err)
+		os.Exit(1)
+	}
+	latest, ok := sqlitebackup.LatestBackup(files, *database)
+	if !ok {
+		logger.Error("No backup files found", "dir", *backupDir, "database", *database)
+		os.Exit(1)
+	}
+	logger.Info("Testing restore of latest backup", "file", latest.Name)
+
+	verifyOpts := sqlitebackup.VerifyOptions{
+		TempDir:   *tempDir,
+		Verifiers: []sqlitebackup.Verifier{queryVerifier(logger, queries)},
+	}
+	if *ageIdentityPath != "" {
+		verifyOpts.Identities, err = sqlitebackup.LoadIdentities(*ageIdentityPath)
+		if err != nil {
+			logger.Error("Failed to load age identity", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// The restored database is removed once verification returns
+	if err := sqlitebackup.VerifyBackupWithOptions(context.Background(), filepath.Join(*backupDir, latest.Name), verifyOpts); err != nil {
+		logger.Error("Restore test failed", "file", latest.Name, "error", err)
+		os.Exit(1)
+	}
+	logger.Info("Restore test passed", "file", latest.Name, "queries", len(queries))
+}
+
+// readQueries reads one query per line. Blank lines and lines starting
+// with -- are skipped.
+func readQueries(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var queries []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "--") {
+			continue
+		}
+		queries = append(queries, line)
+	}
+	return queries, scanner.Err()
+}
+
+// queryVerifier runs every query against the restored database and
+// reports each as passed or failed. A query passes if it returns a row
+// whose first column is neither NULL nor 0, e.g.
+// SELECT count(*) > 0 FROM users.
+func queryVerifier(logger *slog.Logger, queries []string) sqlitebackup.Verifier {
+	return sqlitebackup.VerifierFunc(func(ctx context.Context, conn *sqlite.Conn) error {
+		var failed int
+		for _, query := range queries {
+			if err := runQuery(conn, query); err != nil {
+				logger.Error("FAIL", "query", query, "error", err)
+				failed++
+				continue
+			}
+			logger.Info("PASS", "query", query)
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d validation queries failed", failed, len(queries))
+		}
+		return nil
+	})
+}
+
+// runQuery runs a single validation query.
+func runQuery(conn *sqlite.Conn, query string) error {
+	var rows int
+	var passed bool
+	err := sqlitex.ExecuteTransient(conn, query, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			if rows == 0 {
+				passed = stmt.ColumnType(0) != sqlite.TypeNull && stmt.ColumnText(0) != "0"
+			}
+			rows++
+			return nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return fmt.Errorf("query returned no rows")
+	}
+	if !passed {
+		return fmt.Errorf("query returned false")
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	sqlitebackup "github.com/caasmo/restinpieces-sqlite-backup"
+)
+
+func main() {
+	logOpts := sqlitebackup.RegisterLogFlags(flag.CommandLine)
+
+	backupDir := flag.String("dir", "", "Directory containing the backup files (required)")
+	latest := flag.Int("latest", 1, "Number of newest backups per database that are always verified")
+	samplePercent := flag.Float64("sample", 10, "Percentage of older backups verified at random")
+	inMemory := flag.Bool("in-memory", false, "Verify in memory without writing decompressed databases to disk (needs about twice the database size in RAM)")
+	tempDir := flag.String("temp-dir", "", "Directory for decompressed databases during verification (default: system temp dir)")
+	ageIdentityPath := flag.String("age-identity", "", "Path to the age identity file decrypting encrypted backups")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -dir <backup-dir> [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Verify the newest backups of every database plus a random sample of older ones.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	logger, err := logOpts.NewLogger(os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *backupDir == "" || *latest < 0 || *samplePercent < 0 || *samplePercent > 100 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	entries, err := os.ReadDir(*backupDir)
+	if err != nil {
+		logger.Error("Failed to list backup directory", "path", *backupDir, "error", err)
+		os.Exit(1)
+	}
+
+	var files []sqlitebackup.BackupFile
+	for _, entry := range entries {
+		if entry.IsDir() || !sqlitebackup.IsBackupFile(entry.Name()) {
+			continue
+		}
+		bf, err := sqlitebackup.ParseBackupFilename(entry.Name())
+		if err != nil {
+			logger.Warn("Ignoring file with unexpected name", "file", entry.Name(), "error", err)
+			continue
+		}
+		files = append(files, bf)
+	}
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	toVerify, toSkip := sqlitebackup.SelectForVerification(files, *latest, *samplePercent, rng)
+
+	for _, f := range toSkip {
+		logger.Info("Skipped", "file", f.Name)
+	}
+
+	verifyOpts := sqlitebackup.VerifyOptions{
+		TempDir:  *tempDir,
+		InMemory: *inMemory,
+	}
+	if *ageIdentityPath != "" {
+		verifyOpts.Identities, err = sqlitebackup.LoadIdentities(*ageIdentityPath)
+		if err != nil {
+			logger.Error("Failed to load age identity", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	ctx := context.Background()
+	var failed int
+	for _, f := range toVerify {
+		if err := sqlitebackup.VerifyBackupWithOptions(ctx, filepath.Join(*backupDir, f.Name), verifyOpts); err != nil {
+			logger.Error("Verification failed", "file", f.Name, "error", err)
+			failed++
+			continue
+		}
+		logger.Info("Verified", "file", f.Name)
+	}
+
+	logger.Info("Verification finished", "verified", len(toVerify)-failed, "failed", failed, "skipped", len(toSkip))
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
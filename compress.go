@@ -0,0 +1,421 @@
+package sqlitebackup
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionNone = "none"
+	// CompressionGzipStore writes a gzip container with stored, i.e.
+	// uncompressed, deflate blocks, for pipelines that expect gzip framing
+	// and its CRC but not the compression cost. It is gzip level 0, which
+	// compression_level cannot select because 0 means the codec default.
+	CompressionGzipStore = "gzip-store"
+)
+
+// BackupExtension is the extension of an uncompressed backup file, the
+// codec extension is appended to it.
+const BackupExtension = ".bck"
+
+// DefaultInProgressSuffix is appended to the name of a file while it is
+// being written, by the handler before the atomic rename into place and by
+// the client while downloading. Monitoring and tooling should ignore files
+// ending with it.
+const DefaultInProgressSuffix = ".inprogress"
+
+// IsInProgress reports whether name is a file still being written.
+func IsInProgress(name, suffix string) bool {
+	if suffix == "" {
+		suffix = DefaultInProgressSuffix
+	}
+	return strings.HasSuffix(name, suffix)
+}
+
+// inProgressSuffix returns the configured in-progress suffix.
+func (h *Handler) inProgressSuffix() string {
+	if h.cfg.InProgressSuffix == "" {
+		return DefaultInProgressSuffix
+	}
+	return h.cfg.InProgressSuffix
+}
+
+// DefaultCompressionBufferSize is the size of the buffer data is copied
+// through during compression, the same as io.Copy.
+const DefaultCompressionBufferSize = 32 << 10
+
+// adaptiveSampleSize is the amount of data compressed at a given level
+// before its throughput is used to project the remaining compression time.
+const adaptiveSampleSize = 1 << 20
+
+// compressionExtension returns the file extension for the configured codec.
+func compressionExtension(compression string) (string, error) {
+	switch compression {
+	case CompressionGzip, CompressionGzipStore, "":
+		return ".gz", nil
+	case CompressionZstd:
+		return ".zst", nil
+	case CompressionNone:
+		return "", nil
+	default:
+		return "", fmt.Errorf("unknown compression: %q", compression)
+	}
+}
+
+// IsBackupFile reports whether name is a finished backup file, as opposed
+// to a sidecar or a file still being written.
+func IsBackupFile(name string) bool {
+	for _, ext := range backupExtensions() {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressAndFinalize compresses the temporary backup next to its final
+// path and renames it into place once complete. If the compression saves
+// less than Config.MinCompressionSavings, the backup is stored
+// uncompressed instead. It returns the path of the finished backup.
+func (h *Handler) compressAndFinalize(ctx context.Context, tempBackupPath, finalBackupPath string, manifest *Manifest) (string, error) {
+	compression := manifest.Compression
+	inProgressPath := finalBackupPath + h.inProgressSuffix()
+	if err := h.compressTo(ctx, compression, tempBackupPath, inProgressPath); err != nil {
+		os.Remove(inProgressPath)
+		return "", err
+	}
+
+	uncompressed, err := os.Stat(tempBackupPath)
+	if err != nil {
+		os.Remove(inProgressPath)
+		return "", fmt.Errorf("failed to stat temporary backup: %w", err)
+	}
+	compressed, err := os.Stat(inProgressPath)
+	if err != nil {
+		os.Remove(inProgressPath)
+		return "", fmt.Errorf("failed to stat compressed backup: %w", err)
+	}
+
+	manifest.UncompressedSize = uncompressed.Size()
+	manifest.Size = compressed.Size()
+	if uncompressed.Size() > 0 {
+		manifest.CompressionSavings = 1 - float64(compressed.Size())/float64(uncompressed.Size())
+	}
+
+	if manifest.Compression != CompressionNone && manifest.Compression != CompressionGzipStore && manifest.CompressionSavings < h.cfg.MinCompressionSavings {
+		h.logger.Info("Compression saved too little space, storing backup uncompressed",
+			"savings", manifest.CompressionSavings,
+			"min_savings", h.cfg.MinCompressionSavings,
+		)
+		os.Remove(inProgressPath)
+
+		codecExtension, _ := compressionExtension(compression)
+		encExtension := h.encryptionExtension()
+		finalBackupPath = strings.TrimSuffix(strings.TrimSuffix(finalBackupPath, encExtension), codecExtension) + encExtension
+		inProgressPath = finalBackupPath + h.inProgressSuffix()
+		if err := h.compressTo(ctx, CompressionNone, tempBackupPath, inProgressPath); err != nil {
+			os.Remove(inProgressPath)
+			return "", err
+		}
+		manifest.Compression = CompressionNone
+		manifest.CompressionSkipped = true
+		info, err := os.Stat(inProgressPath)
+		if err != nil {
+			os.Remove(inProgressPath)
+			return "", fmt.Errorf("failed to stat uncompressed backup: %w", err)
+		}
+		manifest.Size = info.Size()
+	}
+
+	// The final path was checked before the copy, the policy applies as
+	// well to a file appearing since or under the uncompressed name
+	if skip, err := h.checkExistingBackup(finalBackupPath); skip || err != nil {
+		os.Remove(inProgressPath)
+		if err == nil {
+			err = errBackupExists
+		}
+		return "", err
+	}
+	// Another instance may have finished a backup while this one was
+	// compressed
+	if h.cfg.SkipIfNewerBackup {
+		if skip, err := h.checkNewerBackup(finalBackupPath, manifest.CreatedAt); skip || err != nil {
+			os.Remove(inProgressPath)
+			if err == nil {
+				err = errNewerBackup
+			}
+			return "", err
+		}
+	}
+	err = h.retryDirOp(ctx, "rename", finalBackupPath, filepath.Dir(finalBackupPath), func() error {
+		return os.Rename(inProgressPath, finalBackupPath)
+	})
+	if err != nil {
+		os.Remove(inProgressPath)
+		return "", fmt.Errorf("failed to rename backup into place: %w", err)
+	}
+	manifest.BackupFile = filepath.Base(finalBackupPath)
+
+	return finalBackupPath, nil
+}
+
+// compressTo compresses sourcePath to destPath. With Config.ScratchDir set
+// the file is compressed there and then moved to destPath, so slow
+// storage only sees a single sequential write of the finished file.
+func (h *Handler) compressTo(ctx context.Context, compression, sourcePath, destPath string) error {
+	if h.cfg.ScratchDir == "" {
+		return h.compressFile(ctx, compression, sourcePath, destPath)
+	}
+
+	if err := os.MkdirAll(h.cfg.ScratchDir, 0700); err != nil {
+		return fmt.Errorf("failed to create scratch directory: %w", err)
+	}
+	scratchPath := filepath.Join(h.cfg.ScratchDir, filepath.Base(destPath))
+	// Removes the scratch file if it was not moved
+	defer os.Remove(scratchPath)
+
+	if err := h.compressFile(ctx, compression, sourcePath, scratchPath); err != nil {
+		return err
+	}
+	// A rename fails across filesystems, the usual case for a scratch
+	// dir, then the file is copied
+	if err := os.Rename(scratchPath, destPath); err == nil {
+		return nil
+	}
+	return h.retryDirOp(ctx, "copy", destPath, filepath.Dir(destPath), func() error {
+		return h.copyFile(scratchPath, destPath)
+	})
+}
+
+// compressFile reads a source file, compresses it with the given codec, and writes to a destination file,
+// encrypted if a recipient is configured.
+func (h *Handler) compressFile(ctx context.Context, compression, sourcePath, destPath string) error {
+	// An uncompressed, unencrypted backup is the temporary copy itself.
+	// On the same filesystem it is hard linked instead of copied, which
+	// fails with EXDEV across filesystems. It gets the mode and owner of
+	// the backup first, the link makes it visible at once.
+	if compression == CompressionNone && !h.encrypted() && h.restrictFile(sourcePath) == nil {
+		if err := os.Link(sourcePath, destPath); err == nil {
+			h.logger.Info("Linked temporary backup instead of copying it", "path", destPath)
+			return nil
+		}
+	}
+
+	sourceFile, err := os.Open(sourcePath)
+	if err != nil {
+		return fmt.Errorf("failed to open source file for compression: %w", err)
+	}
+	defer sourceFile.Close()
+
+	info, err := sourceFile.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat source file for compression: %w", err)
+	}
+
+	var destFile io.WriteCloser
+	err = h.retryDirOp(ctx, "create", destPath, filepath.Dir(destPath), func() error {
+		destFile, err = h.createOutput(destPath)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create destination file for compression: %w", err)
+	}
+
+	switch compression {
+	case CompressionZstd:
+		err = h.compressZstd(ctx, sourceFile, info.Size(), destFile)
+	case CompressionNone:
+		if err = copyBuffer(destFile, sourceFile, h.compressionBuffer()); err != nil {
+			err = fmt.Errorf("failed to copy data: %w", err)
+		}
+	case CompressionGzipStore:
+		err = copyGzip(sourceFile, destFile, gzip.NoCompression, h.compressionBuffer())
+	default:
+		level := h.cfg.CompressionLevel
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		err = copyGzip(sourceFile, destFile, level, h.compressionBuffer())
+	}
+	if err != nil {
+		// A failed copy, e.g. on a full disk, leaves no partial file
+		// behind that could be mistaken for a complete one
+		abortOutput(destFile)
+		os.Remove(destPath)
+		return err
+	}
+
+	if err := destFile.Close(); err != nil {
+		os.Remove(destPath)
+		return fmt.Errorf("failed to finish compressed file: %w", err)
+	}
+	return nil
+}
+
+// compressionBuffer allocates the buffer of Config.CompressionBufferSize.
+func (h *Handler) compressionBuffer() []byte {
+	size := h.cfg.CompressionBufferSize
+	if size <= 0 {
+		size = DefaultCompressionBufferSize
+	}
+	return make([]byte, size)
+}
+
+// copyBuffer copies src to dst through buf. Unlike io.CopyBuffer it never
+// hands the copy to a ReaderFrom or WriterTo, which may allocate buffers
+// of their own, so buf is the only copy buffer.
+func copyBuffer(dst io.Writer, src io.Reader, buf []byte) error {
+	for {
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// copyGzip compresses src into dst as a single gzip member.
+func copyGzip(src io.Reader, dst io.Writer, level int, buf []byte) error {
+	gzipWriter, err := gzip.NewWriterLevel(dst, level)
+	if err != nil {
+		return fmt.Errorf("invalid gzip compression level: %w", err)
+	}
+
+	// On error the writer is not closed, closing would append a valid
+	// trailer to the incomplete stream
+	if err := copyBuffer(gzipWriter, src, buf); err != nil {
+		return fmt.Errorf("failed to copy and compress data: %w", err)
+	}
+
+	if err := gzipWriter.Close(); err != nil {
+		return fmt.Errorf("failed to finish gzip stream: %w", err)
+	}
+	return nil
+}
+
+// compressZstd compresses src into dst. In adaptive mode the level is
+// lowered whenever the throughput measured at the current level projects
+// the compression past the context deadline. Every downgrade closes the
+// current zstd frame and starts a new one, concatenated frames are a valid
+// zstd stream.
+func (h *Handler) compressZstd(ctx context.Context, src io.Reader, size int64, dst io.Writer) error {
+	level := zstd.SpeedDefault
+	if h.cfg.CompressionLevel != 0 {
+		level = zstd.EncoderLevelFromZstd(h.cfg.CompressionLevel)
+	}
+
+	deadline, hasDeadline := ctx.Deadline()
+	if !h.cfg.AdaptiveCompression || !hasDeadline {
+		return copyZstd(src, dst, level, h.compressionBuffer())
+	}
+
+	encoder, err := zstd.NewWriter(dst, zstd.WithEncoderLevel(level))
+	if err != nil {
+		return fmt.Errorf("failed to create zstd encoder: %w", err)
+	}
+	// On error the encoder is discarded, not closed, like in copyZstd
+	failed := true
+	defer func() {
+		if failed {
+			discardZstd(encoder)
+		}
+	}()
+
+	buf := h.compressionBuffer()
+	var remaining = size
+	var sampled int64
+	start := time.Now()
+
+	for {
+		n, readErr := io.ReadFull(src, buf)
+		if n > 0 {
+			if _, err := encoder.Write(buf[:n]); err != nil {
+				return fmt.Errorf("failed to copy and compress data: %w", err)
+			}
+			remaining -= int64(n)
+			sampled += int64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return fmt.Errorf("failed to read data for compression: %w", readErr)
+		}
+
+		if level == zstd.SpeedFastest || sampled < adaptiveSampleSize {
+			continue
+		}
+
+		elapsed := time.Since(start)
+		projected := time.Duration(float64(elapsed) * float64(remaining) / float64(sampled))
+		budget := time.Until(deadline)
+		if projected <= budget {
+			continue
+		}
+
+		if err := encoder.Close(); err != nil {
+			return fmt.Errorf("failed to finish zstd frame: %w", err)
+		}
+		newLevel := level - 1
+		h.logger.Warn("Compression projected to exceed time budget, downgrading zstd level",
+			"from_level", level.String(),
+			"to_level", newLevel.String(),
+			"projected", projected,
+			"budget", budget,
+			"remaining_bytes", remaining,
+		)
+		level = newLevel
+		next, err := zstd.NewWriter(dst, zstd.WithEncoderLevel(level))
+		if err != nil {
+			return fmt.Errorf("failed to create zstd encoder: %w", err)
+		}
+		encoder = next
+		sampled = 0
+		start = time.Now()
+	}
+
+	failed = false
+	return encoder.Close()
+}
+
+// copyZstd compresses src into dst as a single zstd frame.
+func copyZstd(src io.Reader, dst io.Writer, level zstd.EncoderLevel, buf []byte) error {
+	encoder, err := zstd.NewWriter(dst, zstd.WithEncoderLevel(level))
+	if err != nil {
+		return fmt.Errorf("failed to create zstd encoder: %w", err)
+	}
+
+	// On error the encoder is not closed, closing would append a valid
+	// frame end to the incomplete stream
+	if err := copyBuffer(encoder, src, buf); err != nil {
+		discardZstd(encoder)
+		return fmt.Errorf("failed to copy and compress data: %w", err)
+	}
+
+	return encoder.Close()
+}
+
+// discardZstd releases the resources of an encoder whose output is
+// abandoned. It is reset onto io.Discard first, so nothing more reaches
+// the original writer.
+func discardZstd(encoder *zstd.Encoder) {
+	encoder.Reset(io.Discard)
+	encoder.Close()
+}
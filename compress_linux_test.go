@@ -0,0 +1,76 @@
+package sqlitebackup
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// limitFileSize makes writes beyond limit bytes fail with EFBIG, like
+// ulimit -f, until the test ends.
+func limitFileSize(t *testing.T, limit uint64) {
+	t.Helper()
+	var old syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_FSIZE, &old); err != nil {
+		t.Fatal(err)
+	}
+	// The write fails instead of the process being killed
+	signal.Ignore(syscall.SIGXFSZ)
+	if err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &syscall.Rlimit{Cur: limit, Max: old.Max}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		syscall.Setrlimit(syscall.RLIMIT_FSIZE, &old)
+		signal.Reset(syscall.SIGXFSZ)
+	})
+}
+
+func TestCompressFileRemovesOutputOnWriteError(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"gzip", Config{Compression: CompressionGzip}},
+		{"gzip store", Config{Compression: CompressionGzipStore}},
+		{"zstd", Config{Compression: CompressionZstd}},
+		{"encrypted none", Config{Compression: CompressionNone, AgeRecipients: []string{identity.Recipient().String()}}},
+		{"encrypted zstd", Config{Compression: CompressionZstd, AgeRecipients: []string{identity.Recipient().String()}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sourcePath := filepath.Join(dir, "source")
+			if err := os.WriteFile(sourcePath, randomData(1<<20), 0600); err != nil {
+				t.Fatal(err)
+			}
+			destPath := filepath.Join(dir, "backup.bck")
+
+			h := NewHandler(&tt.cfg, discardLogger())
+			limitFileSize(t, 256<<10)
+			err := h.compressFile(context.Background(), tt.cfg.Compression, sourcePath, destPath)
+			if err == nil {
+				t.Fatal("compression onto a full disk succeeded")
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if strings.HasPrefix(e.Name(), "backup.bck") {
+					t.Errorf("partial output %q left behind", e.Name())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package sqlitebackup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"filippo.io/age"
+	"github.com/klauspost/compress/zstd"
+)
+
+// failingSource yields data and then fails, like a disk read error in
+// the middle of a backup.
+func failingSource(data []byte) io.Reader {
+	return io.MultiReader(bytes.NewReader(data), iotest.ErrReader(errors.New("read failed")))
+}
+
+// fullDisk accepts limit bytes and then fails every write, like a disk
+// running full in the middle of a backup.
+type fullDisk struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (w *fullDisk) Write(p []byte) (int, error) {
+	room := max(w.limit-w.buf.Len(), 0)
+	if len(p) <= room {
+		return w.buf.Write(p)
+	}
+	w.buf.Write(p[:room])
+	return room, errors.New("no space left on device")
+}
+
+// randomData returns n incompressible bytes, the same on every call.
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	rand.NewChaCha8([32]byte{}).Read(data)
+	return data
+}
+
+func TestCompressLeavesNoCompleteStreamOnError(t *testing.T) {
+	data := randomData(1 << 20)
+
+	adaptive := NewHandler(&Config{AdaptiveCompression: true}, discardLogger())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	tests := []struct {
+		name     string
+		compress func(src io.Reader, dst io.Writer) error
+		decode   func(r io.Reader) error
+	}{
+		{
+			name: "gzip",
+			compress: func(src io.Reader, dst io.Writer) error {
+				return copyGzip(src, dst, gzip.DefaultCompression, make([]byte, 32*1024))
+			},
+			decode: decodeGzip,
+		},
+		{
+			name: "gzip store",
+			compress: func(src io.Reader, dst io.Writer) error {
+				return copyGzip(src, dst, gzip.NoCompression, make([]byte, 32*1024))
+			},
+			decode: decodeGzip,
+		},
+		{
+			name: "zstd",
+			compress: func(src io.Reader, dst io.Writer) error {
+				return copyZstd(src, dst, zstd.SpeedDefault, make([]byte, 32*1024))
+			},
+			decode: decodeZstd,
+		},
+		{
+			name: "adaptive zstd",
+			compress: func(src io.Reader, dst io.Writer) error {
+				return adaptive.compressZstd(ctx, src, int64(len(data))*2, dst)
+			},
+			decode: decodeZstd,
+		},
+	}
+	failures := []struct {
+		name  string
+		src   func() io.Reader
+		limit int
+	}{
+		{"source fails", func() io.Reader { return failingSource(data) }, 2 * len(data)},
+		{"destination fails", func() io.Reader { return bytes.NewReader(data) }, len(data) / 4},
+	}
+	for _, tt := range tests {
+		for _, f := range failures {
+			t.Run(tt.name+"/"+f.name, func(t *testing.T) {
+				out := &fullDisk{limit: f.limit}
+				if err := tt.compress(f.src(), out); err == nil {
+					t.Fatal("compression succeeded despite the failure")
+				}
+				// A finished stream would decode cleanly and pass for a
+				// complete backup of the partial data
+				if out.buf.Len() > 0 && tt.decode(&out.buf) == nil {
+					t.Error("failed compression left a complete stream behind")
+				}
+			})
+		}
+	}
+}
+
+func decodeGzip(r io.Reader) error {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, gr)
+	return err
+}
+
+func decodeZstd(r io.Reader) error {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	_, err = io.Copy(io.Discard, zr)
+	return err
+}
+
+func TestCompressFileRemovesPartialOutput(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"gzip", Config{Compression: CompressionGzip}},
+		{"gzip store", Config{Compression: CompressionGzipStore}},
+		{"zstd", Config{Compression: CompressionZstd}},
+		{"none", Config{Compression: CompressionNone}},
+		{"encrypted zstd", Config{Compression: CompressionZstd, AgeRecipients: []string{identity.Recipient().String()}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			// Reading a directory fails after it was opened
+			sourcePath := filepath.Join(dir, "source")
+			if err := os.Mkdir(sourcePath, 0700); err != nil {
+				t.Fatal(err)
+			}
+			destPath := filepath.Join(dir, "backup.bck")
+
+			h := NewHandler(&tt.cfg, discardLogger())
+			err := h.compressFile(context.Background(), tt.cfg.Compression, sourcePath, destPath)
+			if err == nil {
+				t.Fatal("compressing an unreadable source succeeded")
+			}
+			if _, err := os.Stat(destPath); !os.IsNotExist(err) {
+				t.Errorf("partial output %q left behind: %v", destPath, err)
+			}
+			entries, _ := os.ReadDir(dir)
+			for _, e := range entries {
+				if strings.HasPrefix(e.Name(), "backup.bck") {
+					t.Errorf("partial output %q left behind", e.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestCompressAndFinalizeAppliesPolicyToAppearedBackup(t *testing.T) {
+	tests := []struct {
+		policy      string
+		wantErr     error
+		wantRenamed bool
+	}{
+		{ExistingBackupError, nil, false},
+		{ExistingBackupSkip, errBackupExists, false},
+		{ExistingBackupOverwrite, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			dir := t.TempDir()
+			tempPath := filepath.Join(dir, "temp.db")
+			createTestDatabase(t, tempPath)
+			finalPath := filepath.Join(dir, "app-2025-07-01T10-30-00Z-vacuum.bck.gz")
+			// Another run finished the same backup during the compression
+			existing := []byte("existing backup")
+			if err := os.WriteFile(finalPath, existing, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			h := NewHandler(&Config{ExistingBackupPolicy: tt.policy}, discardLogger())
+			manifest := &Manifest{Compression: CompressionGzip}
+			_, err := h.compressAndFinalize(context.Background(), tempPath, finalPath, manifest)
+
+			switch {
+			case tt.wantRenamed && err != nil:
+				t.Fatal(err)
+			case !tt.wantRenamed && err == nil:
+				t.Fatal("existing backup was replaced without error")
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			got, err := os.ReadFile(finalPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if replaced := !bytes.Equal(got, existing); replaced != tt.wantRenamed {
+				t.Errorf("existing backup replaced: %v, want %v", replaced, tt.wantRenamed)
+			}
+			if _, err := os.Stat(finalPath + h.inProgressSuffix()); !os.IsNotExist(err) {
+				t.Errorf("in-progress file left behind: %v", err)
+			}
+		})
+	}
+}
+
+func TestCompressZstdAdaptiveDowngrade(t *testing.T) {
+	data := randomData(5 << 20)
+
+	tests := []struct {
+		name           string
+		level          int
+		wantDowngrades int
+	}{
+		{"default level", 0, 1},
+		{"best level", 19, 3},
+		{"fastest level", 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			cfg := &Config{AdaptiveCompression: true, CompressionLevel: tt.level}
+			h := NewHandler(cfg, slog.New(slog.NewTextHandler(&logs, nil)))
+			// A deadline already passed projects every level past the budget
+			ctx, cancel := context.WithDeadline(context.Background(), time.Now())
+			defer cancel()
+
+			var out bytes.Buffer
+			if err := h.compressZstd(ctx, bytes.NewReader(data), int64(len(data)), &out); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := strings.Count(logs.String(), "downgrading zstd level"); got != tt.wantDowngrades {
+				t.Errorf("got %d downgrades, want %d", got, tt.wantDowngrades)
+			}
+			// Every downgrade starts a new frame, a decoder reads them all
+			zr, err := zstd.NewReader(&out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer zr.Close()
+			got, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("decompressed %d bytes differing from the %d bytes compressed", len(got), len(data))
+			}
+		})
+	}
+}
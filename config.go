@@ -0,0 +1,235 @@
+package sqlitebackup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+const (
+	DefaultStrategy      = StrategyOnline
+	DefaultPagesPerStep  = 100
+	DefaultSleepInterval = 10 * time.Millisecond
+	DefaultCompression   = CompressionGzip
+)
+
+// renamedKey is the current name of a config key of an older release.
+type renamedKey struct {
+	key string
+	// merge combines the old value with the current one, nil if key is
+	// not set. Without it the old value is moved as is, and dropped if
+	// key is set as well.
+	merge func(old, current any) any
+}
+
+// renamedKeys maps config keys of older releases to their current name.
+var renamedKeys = map[string]renamedKey{
+	// The single recipient predates the list, both are encrypted to
+	"age_recipient": {"age_recipients", func(old, current any) any {
+		recipients, _ := current.([]any)
+		if slices.Contains(recipients, old) {
+			return recipients
+		}
+		return append([]any{old}, recipients...)
+	}},
+}
+
+// deprecatedKeys lists config keys that are still accepted but ignored,
+// together with the upgrade guidance returned as warning. Keys with a
+// replacement belong in renamedKeys; no key was dropped without one yet.
+var deprecatedKeys = map[string]string{}
+
+// configDefault describes the default applied when a key is missing.
+type configDefault struct {
+	key   string
+	apply func(*Config)
+}
+
+// configDefaults returns the defaults for optional keys, in file order.
+// Keys whose default is the zero value, e.g. every bool, are not listed.
+func configDefaults() []configDefault {
+	return []configDefault{
+		{"strategy", func(c *Config) { c.Strategy = DefaultStrategy }},
+		{"pages_per_step", func(c *Config) { c.PagesPerStep = DefaultPagesPerStep }},
+		{"sleep_interval", func(c *Config) { c.SleepInterval = Duration{Duration: DefaultSleepInterval} }},
+		{"compression", func(c *Config) { c.Compression = DefaultCompression }},
+		{"compression_buffer_size", func(c *Config) { c.CompressionBufferSize = DefaultCompressionBufferSize }},
+		{"dirty_source_policy", func(c *Config) { c.DirtySourcePolicy = DirtySourceIgnore }},
+		{"page_count_drop_action", func(c *Config) { c.PageCountDropAction = PageCountDropWarn }},
+		{"existing_backup_policy", func(c *Config) { c.ExistingBackupPolicy = ExistingBackupError }},
+		{"in_progress_suffix", func(c *Config) { c.InProgressSuffix = DefaultInProgressSuffix }},
+		{"backup_dir_backoff", func(c *Config) { c.BackupDirBackoff = Duration{Duration: DefaultBackupDirBackoff} }},
+		{"filename_scheme", func(c *Config) { c.FilenameScheme = FilenameSchemeTimestamp }},
+		{"duration_window", func(c *Config) { c.DurationWindow = DefaultDurationWindow }},
+	}
+}
+
+// MigrateConfig unmarshals a TOML config written by any previous release.
+// Renamed keys are mapped to their current name and missing optional keys
+// get their default value. The returned warnings describe every renamed,
+// deprecated or unknown key, so callers can tell operators how to upgrade
+// the stored config. A missing optional key is not a warning, the config
+// needs no upgrade for it.
+func MigrateConfig(raw []byte) (Config, []string, error) {
+	var cfg Config
+	var warnings []string
+
+	var fields map[string]any
+	if err := toml.Unmarshal(raw, &fields); err != nil {
+		return cfg, nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	for oldKey, renamed := range renamedKeys {
+		newKey := renamed.key
+		value, ok := fields[oldKey]
+		if !ok {
+			continue
+		}
+		current, exists := fields[newKey]
+		switch {
+		case isEmptyValue(value):
+			// Nothing to move, e.g. the empty key of an older blueprint
+			warnings = append(warnings, fmt.Sprintf("config key %q is deprecated and empty; remove it", oldKey))
+		case renamed.merge != nil:
+			fields[newKey] = renamed.merge(value, current)
+			warnings = append(warnings, fmt.Sprintf("config key %q is deprecated, move its value to %q", oldKey, newKey))
+		case exists:
+			warnings = append(warnings, fmt.Sprintf("config key %q is deprecated and ignored because %q is also set; remove it", oldKey, newKey))
+		default:
+			fields[newKey] = value
+			warnings = append(warnings, fmt.Sprintf("config key %q is deprecated, rename it to %q", oldKey, newKey))
+		}
+		delete(fields, oldKey)
+	}
+
+	for key, guidance := range deprecatedKeys {
+		if _, ok := fields[key]; ok {
+			warnings = append(warnings, fmt.Sprintf("config key %q is deprecated: %s", key, guidance))
+			delete(fields, key)
+		}
+	}
+
+	for _, d := range configDefaults() {
+		if _, ok := fields[d.key]; !ok {
+			d.apply(&cfg)
+		}
+	}
+
+	migrated, err := toml.Marshal(fields)
+	if err != nil {
+		return cfg, nil, fmt.Errorf("failed to re-encode migrated config: %w", err)
+	}
+
+	dec := toml.NewDecoder(bytes.NewReader(migrated))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		// Unknown keys are reported but do not fail the migration, the
+		// decoder still fills in every known field.
+		var strictErr *toml.StrictMissingError
+		if !errors.As(err, &strictErr) {
+			return cfg, nil, fmt.Errorf("failed to decode migrated config: %w", err)
+		}
+		for _, e := range strictErr.Errors {
+			warnings = append(warnings, fmt.Sprintf("config key %q is unknown and ignored", strings.Join(e.Key(), ".")))
+		}
+	}
+
+	return cfg, warnings, nil
+}
+
+// isEmptyValue reports whether a decoded TOML value is empty, e.g. "" or
+// an empty list.
+func isEmptyValue(value any) bool {
+	v := reflect.ValueOf(value)
+	if !v.IsValid() || v.IsZero() {
+		return true
+	}
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return false
+}
+
+// Validate checks the configuration of the handler without running a
+// backup, e.g. at startup. Jobs run the same checks.
+func (h *Handler) Validate() error {
+	if h.cfg.SourcePath == "" || h.cfg.BackupDir == "" {
+		return fmt.Errorf("invalid configuration: source_path and backup_dir are required")
+	}
+
+	s, err := h.lookupStrategy(h.cfg.Strategy)
+	if err != nil {
+		return err
+	}
+	if s.validate != nil {
+		if err := s.validate(h); err != nil {
+			return err
+		}
+	}
+	if h.cfg.FallbackStrategy != "" && h.cfg.FallbackStrategy != StrategyVacuum {
+		return fmt.Errorf("unsupported fallback strategy: %q, only %q is supported", h.cfg.FallbackStrategy, StrategyVacuum)
+	}
+
+	if _, err := compressionExtension(h.cfg.Compression); err != nil {
+		return err
+	}
+	if _, err := h.filenameLocation(); err != nil {
+		return err
+	}
+	if h.cfg.SigningKeyPath != "" {
+		if _, err := LoadSigningKey(h.cfg.SigningKeyPath); err != nil {
+			return err
+		}
+	}
+	if err := h.validateEncryptionConfig(); err != nil {
+		return err
+	}
+	if _, err := h.inMaintenanceWindow(time.Now()); err != nil {
+		return err
+	}
+
+	if h.cfg.VerifyPageSampleRate < 0 || h.cfg.VerifyPageSampleRate > 1 {
+		return fmt.Errorf("invalid verify_page_sample_rate: %v, expected a fraction between 0 and 1", h.cfg.VerifyPageSampleRate)
+	}
+	if h.cfg.VerifyPageSampleRate > 0 && h.cfg.Strategy == StrategyForensic {
+		return fmt.Errorf("invalid configuration: verify_page_sample_rate is not supported with the forensic strategy, its archives hold a WAL")
+	}
+	if err := h.validateBundleConfig(); err != nil {
+		return err
+	}
+	if h.cfg.RetentionGracePeriod.Duration < 0 {
+		return fmt.Errorf("invalid configuration: retention_grace_period must not be negative")
+	}
+	if h.cfg.BackupDirRetries < 0 || h.cfg.BackupDirBackoff.Duration < 0 {
+		return fmt.Errorf("invalid configuration: backup_dir_retries and backup_dir_backoff must not be negative")
+	}
+
+	for key, mode := range map[string]string{"file_mode": h.cfg.FileMode, "dir_mode": h.cfg.DirMode} {
+		if _, err := parseMode(mode); mode != "" && err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+	}
+
+	policies := []struct {
+		key, value string
+		allowed    []string
+	}{
+		{"dirty_source_policy", h.cfg.DirtySourcePolicy, []string{DirtySourceIgnore, DirtySourceWarn, DirtySourceRefuse, DirtySourceCheckpoint}},
+		{"existing_backup_policy", h.cfg.ExistingBackupPolicy, []string{ExistingBackupError, ExistingBackupOverwrite, ExistingBackupSkip}},
+		{"page_count_drop_action", h.cfg.PageCountDropAction, []string{PageCountDropWarn, PageCountDropSkipRetention}},
+		{"filename_scheme", h.cfg.FilenameScheme, []string{FilenameSchemeTimestamp, FilenameSchemeReverse}},
+	}
+	for _, p := range policies {
+		if p.value != "" && !slices.Contains(p.allowed, p.value) {
+			return fmt.Errorf("invalid %s: %q, expected one of %s", p.key, p.value, strings.Join(p.allowed, ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package sqlitebackup
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMigrateConfigRenamesAgeRecipient(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    []string
+		warning string
+	}{
+		{
+			name:    "single recipient",
+			raw:     `age_recipient = "age1a"`,
+			want:    []string{"age1a"},
+			warning: `config key "age_recipient" is deprecated, move its value to "age_recipients"`,
+		},
+		{
+			name:    "combined with list",
+			raw:     "age_recipient = \"age1a\"\nage_recipients = [\"age1b\", \"age1c\"]",
+			want:    []string{"age1a", "age1b", "age1c"},
+			warning: `config key "age_recipient" is deprecated, move its value to "age_recipients"`,
+		},
+		{
+			name:    "already in list",
+			raw:     "age_recipient = \"age1b\"\nage_recipients = [\"age1b\"]",
+			want:    []string{"age1b"},
+			warning: `config key "age_recipient" is deprecated, move its value to "age_recipients"`,
+		},
+		{
+			// The blueprint of earlier releases held both keys empty
+			name:    "empty blueprint keys",
+			raw:     "age_recipient = ''\nage_recipients = []",
+			want:    []string{},
+			warning: `config key "age_recipient" is deprecated and empty; remove it`,
+		},
+		{
+			name:    "empty single recipient",
+			raw:     "age_recipient = ''",
+			warning: `config key "age_recipient" is deprecated and empty; remove it`,
+		},
+		{
+			name: "list only",
+			raw:  `age_recipients = ["age1b"]`,
+			want: []string{"age1b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, warnings, err := MigrateConfig([]byte(tt.raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.AgeRecipient != "" {
+				t.Errorf("age_recipient kept as %q", cfg.AgeRecipient)
+			}
+			if !reflect.DeepEqual(cfg.AgeRecipients, tt.want) {
+				t.Errorf("age_recipients = %v, want %v", cfg.AgeRecipients, tt.want)
+			}
+			if tt.warning != "" && !slices.Contains(warnings, tt.warning) {
+				t.Errorf("missing warning %q in %q", tt.warning, warnings)
+			}
+			for _, w := range warnings {
+				if strings.Contains(w, "unknown") {
+					t.Errorf("unexpected warning %q", w)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateConfigDefaults(t *testing.T) {
+	// A config of the first release
+	raw := `
+source_path = "/var/lib/app/app.db"
+backup_dir = "/var/backups/app"
+strategy = "vacuum"
+`
+	cfg, warnings, err := MigrateConfig([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want Config
+	want.SourcePath = "/var/lib/app/app.db"
+	want.BackupDir = "/var/backups/app"
+	want.Strategy = StrategyVacuum
+	for _, d := range configDefaults() {
+		if d.key != "strategy" {
+			d.apply(&want)
+		}
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got %+v, want %+v", cfg, want)
+	}
+	// Missing optional keys need no upgrade
+	if len(warnings) > 0 {
+		t.Errorf("got warnings %q, want none", warnings)
+	}
+
+	// Every default is a valid value of its key
+	h := NewHandler(&cfg, discardLogger())
+	if err := h.Validate(); err != nil {
+		t.Errorf("migrated config is invalid: %v", err)
+	}
+}
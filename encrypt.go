@@ -0,0 +1,154 @@
+package sqlitebackup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// EncryptionExtension is appended to the name of files encrypted with age.
+const EncryptionExtension = ".age"
+
+// encrypted reports whether at least one age recipient or envelope
+// encryption is configured.
+func (h *Handler) encrypted() bool {
+	return h.cfg.AgeRecipient != "" || len(h.cfg.AgeRecipients) > 0 || h.envelopeEncrypted()
+}
+
+// encryptionExtension returns the extension of encrypted output, empty if
+// encryption is disabled.
+func (h *Handler) encryptionExtension() string {
+	if !h.encrypted() {
+		return ""
+	}
+	return EncryptionExtension
+}
+
+// recipients parses the configured age recipients and adds the data key
+// of the run, if any. Any of their identities can decrypt the output.
+func (h *Handler) recipients() ([]age.Recipient, error) {
+	keys := h.cfg.AgeRecipients
+	if h.cfg.AgeRecipient != "" {
+		keys = append([]string{h.cfg.AgeRecipient}, keys...)
+	}
+
+	recipients := make([]age.Recipient, 0, len(keys))
+	for _, key := range keys {
+		recipient, err := age.ParseX25519Recipient(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipient %q: %w", key, err)
+		}
+		recipients = append(recipients, recipient)
+	}
+	if h.dataKeyRecipient != nil {
+		recipients = append(recipients, h.dataKeyRecipient)
+	}
+	return recipients, nil
+}
+
+// validateEncryptionConfig checks the encryption settings.
+func (h *Handler) validateEncryptionConfig() error {
+	if !h.encrypted() {
+		if h.cfg.EncryptSidecars {
+			return fmt.Errorf("invalid configuration: encrypt_sidecars requires age_recipient or age_recipients")
+		}
+		return nil
+	}
+	if h.envelopeEncrypted() {
+		if h.keyWrapper == nil {
+			return fmt.Errorf("invalid configuration: kms_key_id requires a KeyWrapper, see Handler.SetKeyWrapper")
+		}
+		// The wrapped data key is needed to decrypt the manifest itself
+		if h.cfg.EncryptSidecars {
+			return fmt.Errorf("invalid configuration: encrypt_sidecars cannot be combined with kms_key_id, the manifest holds the wrapped data key")
+		}
+	}
+	_, err := h.recipients()
+	return err
+}
+
+// encryptedWriter closes the age writer before the underlying file.
+type encryptedWriter struct {
+	io.WriteCloser
+	file *os.File
+}
+
+// Close finishes the age stream and closes the file.
+func (w *encryptedWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		w.file.Close()
+		return fmt.Errorf("failed to finish encryption: %w", err)
+	}
+	return w.file.Close()
+}
+
+// abortOutput closes an output created by createOutput after a failed
+// write, without finishing the age stream.
+func abortOutput(w io.WriteCloser) {
+	if ew, ok := w.(*encryptedWriter); ok {
+		ew.file.Close()
+		return
+	}
+	w.Close()
+}
+
+// createOutput creates the file at path. If recipients are configured,
+// everything written is encrypted to them.
+func (h *Handler) createOutput(path string) (io.WriteCloser, error) {
+	file, err := h.createFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !h.encrypted() {
+		return file, nil
+	}
+
+	recipients, err := h.recipients()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	w, err := age.Encrypt(file, recipients...)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to start encryption: %w", err)
+	}
+	return &encryptedWriter{WriteCloser: w, file: file}, nil
+}
+
+// LoadIdentities reads the age identities (private keys) from a file.
+func LoadIdentities(path string) ([]age.Identity, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open age identity file: %w", err)
+	}
+	defer file.Close()
+
+	identities, err := age.ParseIdentities(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse age identity file: %w", err)
+	}
+	return identities, nil
+}
+
+// openDecrypted returns a reader of the plaintext of an age encrypted file
+// and the name of the file without EncryptionExtension. Files without the
+// extension are returned unchanged.
+func openDecrypted(r io.Reader, name string, identities []age.Identity) (io.Reader, string, error) {
+	plainName, encrypted := strings.CutSuffix(name, EncryptionExtension)
+	if !encrypted {
+		return r, name, nil
+	}
+	if len(identities) == 0 {
+		return nil, "", fmt.Errorf("%q is encrypted but no age identity was given", name)
+	}
+
+	plain, err := age.Decrypt(r, identities...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decrypt %q: %w", name, err)
+	}
+	return plain, plainName, nil
+}
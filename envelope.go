@@ -0,0 +1,71 @@
+package sqlitebackup
+
+import (
+	"context"
+	"fmt"
+
+	"filippo.io/age"
+)
+
+// KeyWrapper wraps and unwraps data keys with a key management service,
+// e.g. the Encrypt and Decrypt calls of AWS KMS. keyID is
+// Config.KMSKeyID.
+type KeyWrapper interface {
+	WrapKey(ctx context.Context, keyID string, plaintext []byte) ([]byte, error)
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// SetKeyWrapper sets the KeyWrapper used for envelope encryption, see
+// Config.KMSKeyID. Call it before the handler is registered.
+func (h *Handler) SetKeyWrapper(w KeyWrapper) {
+	h.keyWrapper = w
+}
+
+// envelopeEncrypted reports whether backups are encrypted with a data key
+// wrapped by the KeyWrapper.
+func (h *Handler) envelopeEncrypted() bool {
+	return h.cfg.KMSKeyID != ""
+}
+
+// newDataKey generates the age identity a single backup is encrypted to
+// and wraps it with the KeyWrapper. The recipient is added to the
+// recipients of the handler, the wrapped key is stored in the manifest.
+func (h *Handler) newDataKey(ctx context.Context, manifest *Manifest) error {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		return fmt.Errorf("failed to generate data key: %w", err)
+	}
+	wrapped, err := h.keyWrapper.WrapKey(ctx, h.cfg.KMSKeyID, []byte(identity.String()))
+	if err != nil {
+		return fmt.Errorf("failed to wrap data key: %w", err)
+	}
+
+	h.dataKeyRecipient = identity.Recipient()
+	manifest.KMSKeyID = h.cfg.KMSKeyID
+	manifest.WrappedDataKey = wrapped
+	return nil
+}
+
+// UnwrapDataKey returns the age identity decrypting an envelope encrypted
+// backup. The data key is read from the manifest of the backup and
+// unwrapped with w. Pass the identity to VerifyOptions, OpenOptions or
+// DecompressFile like any other identity.
+func UnwrapDataKey(ctx context.Context, backupPath string, w KeyWrapper) (age.Identity, error) {
+	manifest, err := ReadManifest(backupPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(manifest.WrappedDataKey) == 0 {
+		return nil, fmt.Errorf("manifest of %q has no wrapped data key", backupPath)
+	}
+
+	key, err := w.UnwrapKey(ctx, manifest.KMSKeyID, manifest.WrappedDataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	identity, err := age.ParseX25519Identity(string(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse data key: %w", err)
+	}
+	return identity, nil
+}
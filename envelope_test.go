@@ -0,0 +1,139 @@
+package sqlitebackup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/caasmo/restinpieces/db"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// fakeKeyWrapper wraps keys by prefixing them with the key id, like a
+// KMS that only unwraps with the key it wrapped with.
+type fakeKeyWrapper struct {
+	wrapErr   error
+	unwrapErr error
+}
+
+func (w fakeKeyWrapper) WrapKey(ctx context.Context, keyID string, plaintext []byte) ([]byte, error) {
+	if w.wrapErr != nil {
+		return nil, w.wrapErr
+	}
+	return append([]byte(keyID+":"), bytes.ToLower(plaintext)...), nil
+}
+
+func (w fakeKeyWrapper) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	if w.unwrapErr != nil {
+		return nil, w.unwrapErr
+	}
+	key, ok := bytes.CutPrefix(wrapped, []byte(keyID+":"))
+	if !ok {
+		return nil, fmt.Errorf("data key not wrapped with %q", keyID)
+	}
+	return bytes.ToUpper(key), nil
+}
+
+// envelopeBackup writes an envelope encrypted backup of a new database
+// with w and returns the backup directory.
+func envelopeBackup(t *testing.T, w KeyWrapper) (string, error) {
+	t.Helper()
+	dir := t.TempDir()
+	sourcePath := filepath.Join(dir, "app.db")
+	createTestDatabase(t, sourcePath)
+	cfg := Config{
+		SourcePath:  sourcePath,
+		BackupDir:   filepath.Join(dir, "backups"),
+		Strategy:    StrategyVacuum,
+		Compression: CompressionGzip,
+		KMSKeyID:    "backup-key",
+	}
+	h := NewHandler(&cfg, discardLogger())
+	if w != nil {
+		h.SetKeyWrapper(w)
+	}
+	return cfg.BackupDir, h.Handle(context.Background(), db.Job{})
+}
+
+func TestEnvelopeEncryptionRoundTrip(t *testing.T) {
+	wrapper := fakeKeyWrapper{}
+	backupDir, err := envelopeBackup(t, wrapper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backups, err := filepath.Glob(filepath.Join(backupDir, "app-*-vacuum.bck.gz"+EncryptionExtension))
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("got backups %q, %v, want one", backups, err)
+	}
+
+	manifest, err := ReadManifest(backups[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.KMSKeyID != "backup-key" || bytes.Contains(manifest.WrappedDataKey, []byte("AGE-SECRET-KEY")) {
+		t.Errorf("manifest holds key id %q and data key %q, want a wrapped key", manifest.KMSKeyID, manifest.WrappedDataKey)
+	}
+
+	identity, err := UnwrapDataKey(context.Background(), backups[0], wrapper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restoredPath := filepath.Join(t.TempDir(), "app.db")
+	if err := DecompressFile(backups[0], restoredPath, identity); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := sqlite.OpenConn(restoredPath, sqlite.OpenReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	count, err := sqlitex.ResultInt(conn.Prep("SELECT count(*) FROM t;"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("got %d rows in the restored database, want 3", count)
+	}
+}
+
+func TestEnvelopeEncryptionWrapperFailure(t *testing.T) {
+	errKMS := errors.New("kms unavailable")
+
+	tests := []struct {
+		name    string
+		wrapper KeyWrapper
+	}{
+		{"no wrapper", nil},
+		{"wrap fails", fakeKeyWrapper{wrapErr: errKMS}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backupDir, err := envelopeBackup(t, tt.wrapper)
+			if err == nil {
+				t.Fatal("backup without a wrapped data key succeeded")
+			}
+			// No backup is left that nobody could decrypt
+			if backups, _ := filepath.Glob(filepath.Join(backupDir, "app-*")); len(backups) > 0 {
+				t.Errorf("backups %q left behind", backups)
+			}
+		})
+	}
+
+	t.Run("unwrap fails", func(t *testing.T) {
+		backupDir, err := envelopeBackup(t, fakeKeyWrapper{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		backups, err := filepath.Glob(filepath.Join(backupDir, "app-*-vacuum.bck.gz"+EncryptionExtension))
+		if err != nil || len(backups) != 1 {
+			t.Fatalf("got backups %q, %v, want one", backups, err)
+		}
+		if _, err := UnwrapDataKey(context.Background(), backups[0], fakeKeyWrapper{unwrapErr: errKMS}); !errors.Is(err, errKMS) {
+			t.Errorf("got error %v, want %v", err, errKMS)
+		}
+	})
+}
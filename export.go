@@ -0,0 +1,208 @@
+package sqlitebackup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// StrategyExport is not a backup of the database. It exports the rows of
+// a single table, Config.ExportTable, added since the previous export
+// into a small SQLite database holding only that table. Rows are selected
+// by Config.ExportColumn, which must grow monotonically, e.g. the integer
+// primary key or an insertion timestamp of an append-only log table.
+// Updated or deleted rows are not exported.
+//
+// The highest exported value, the watermark, is stored in a state file
+// once the export is finished, the first export holds every row. The rows
+// are read in a single transaction, so an export is consistent.
+const StrategyExport = "export"
+
+// ExportRange describes the rows held by an export, the ones with After <
+// Column <= Through. After is nil for the first export.
+type ExportRange struct {
+	Table   string `json:"table"`
+	Column  string `json:"column"`
+	After   any    `json:"after"`
+	Through any    `json:"through"`
+	Rows    int64  `json:"rows"`
+}
+
+// exportState is the state file of StrategyExport.
+type exportState struct {
+	Table     string    `json:"table"`
+	Column    string    `json:"column"`
+	Watermark any       `json:"watermark"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// exportStatePath returns the path of the state file of the export of
+// the database named database.
+func (h *Handler) exportStatePath(database string) string {
+	if h.cfg.ExportStateFile != "" {
+		return h.cfg.ExportStateFile
+	}
+	return filepath.Join(h.cfg.BackupDir, fmt.Sprintf(".%s-%s.export.json", database, h.cfg.ExportTable))
+}
+
+// validateExportConfig checks the settings of StrategyExport.
+func (h *Handler) validateExportConfig() error {
+	if h.cfg.ExportTable == "" || h.cfg.ExportColumn == "" {
+		return fmt.Errorf("invalid configuration: the export strategy requires export_table and export_column")
+	}
+	return nil
+}
+
+// readExportWatermark returns the watermark of the previous export, nil if
+// there was none. A state file of another table or column is an error, so
+// a config change does not silently export a wrong range.
+func (h *Handler) readExportWatermark(statePath string) (any, error) {
+	data, err := os.ReadFile(statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read export state: %w", err)
+	}
+
+	var state exportState
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&state); err != nil {
+		return nil, fmt.Errorf("failed to parse export state %q: %w", statePath, err)
+	}
+	if state.Table != h.cfg.ExportTable || state.Column != h.cfg.ExportColumn {
+		return nil, fmt.Errorf("export state %q is for %s.%s, not %s.%s; remove it to export every row again",
+			statePath, state.Table, state.Column, h.cfg.ExportTable, h.cfg.ExportColumn)
+	}
+	if n, ok := state.Watermark.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			return i, nil
+		}
+		return nil, fmt.Errorf("export state %q has a non-integer numeric watermark %s", statePath, n)
+	}
+	return state.Watermark, nil
+}
+
+// writeExportState stores the watermark of a finished export. The state
+// is written next to its final path and renamed into place.
+func (h *Handler) writeExportState(statePath string, r *ExportRange) error {
+	data, err := json.MarshalIndent(exportState{
+		Table:     r.Table,
+		Column:    r.Column,
+		Watermark: r.Through,
+		UpdatedAt: time.Now().UTC(),
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal export state: %w", err)
+	}
+
+	inProgressPath := statePath + h.inProgressSuffix()
+	if err := h.writeFile(inProgressPath, append(data, '\n')); err != nil {
+		os.Remove(inProgressPath)
+		return fmt.Errorf("failed to write export state: %w", err)
+	}
+	if err := os.Rename(inProgressPath, statePath); err != nil {
+		os.Remove(inProgressPath)
+		return fmt.Errorf("failed to rename export state into place: %w", err)
+	}
+	return h.applyPermissions(statePath)
+}
+
+// exportTable copies the rows of Config.ExportTable newer than watermark
+// into a new database at destPath, with the table created by its original
+// CREATE TABLE statement. Indexes and triggers are not copied.
+func (h *Handler) exportTable(ctx context.Context, sourcePath, destPath string, watermark any) (*ExportRange, error) {
+	conn, err := sqlite.OpenConn(destPath, sqlite.OpenReadWrite|sqlite.OpenCreate|sqlite.OpenURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create export db: %w", err)
+	}
+	defer conn.Close()
+	conn.SetInterrupt(ctx.Done())
+
+	sourceURI := (&url.URL{Scheme: "file", Path: sourcePath, RawQuery: "mode=ro"}).String()
+	if err := sqlitex.Execute(conn, "ATTACH DATABASE ? AS src;", &sqlitex.ExecOptions{Args: []any{sourceURI}}); err != nil {
+		return nil, fmt.Errorf("failed to attach source db for export: %w", err)
+	}
+
+	var createSQL string
+	err = sqlitex.Execute(conn, "SELECT sql FROM src.sqlite_schema WHERE type = 'table' AND name = ?;", &sqlitex.ExecOptions{
+		Args: []any{h.cfg.ExportTable},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			createSQL = stmt.ColumnText(0)
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema of table %q: %w", h.cfg.ExportTable, err)
+	}
+	if createSQL == "" {
+		return nil, fmt.Errorf("table %q not found in source db", h.cfg.ExportTable)
+	}
+
+	// The CREATE TABLE statement names the table without schema, so it is
+	// created in the export database
+	if err := sqlitex.ExecuteTransient(conn, createSQL, nil); err != nil {
+		return nil, fmt.Errorf("failed to create export table: %w", err)
+	}
+
+	table := quoteIdentifier(h.cfg.ExportTable)
+	column := quoteIdentifier(h.cfg.ExportColumn)
+	insert := fmt.Sprintf("INSERT INTO main.%s SELECT * FROM src.%s", table, table)
+	var args []any
+	if watermark != nil {
+		insert += fmt.Sprintf(" WHERE %s > ?", column)
+		args = append(args, watermark)
+	}
+	if err := sqlitex.Execute(conn, insert+";", &sqlitex.ExecOptions{Args: args}); err != nil {
+		return nil, fmt.Errorf("failed to export rows of table %q: %w", h.cfg.ExportTable, err)
+	}
+
+	r := &ExportRange{
+		Table:   h.cfg.ExportTable,
+		Column:  h.cfg.ExportColumn,
+		After:   watermark,
+		Through: watermark,
+		Rows:    int64(conn.Changes()),
+	}
+	if r.Rows > 0 {
+		err = sqlitex.Execute(conn, fmt.Sprintf("SELECT max(%s) FROM main.%s;", column, table), &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				switch stmt.ColumnType(0) {
+				case sqlite.TypeInteger:
+					r.Through = stmt.ColumnInt64(0)
+				case sqlite.TypeText:
+					r.Through = stmt.ColumnText(0)
+				default:
+					return fmt.Errorf("export column %q must hold integers or text, got %v", h.cfg.ExportColumn, stmt.ColumnType(0))
+				}
+				return nil
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read export watermark: %w", err)
+		}
+	}
+
+	if err := sqlitex.ExecuteTransient(conn, "DETACH DATABASE src;", nil); err != nil {
+		return nil, fmt.Errorf("failed to detach source db: %w", err)
+	}
+	h.logger.Info("Exported table rows", "table", r.Table, "column", r.Column, "after", r.After, "through", r.Through, "rows", r.Rows)
+	return r, nil
+}
+
+// quoteIdentifier quotes an SQL identifier.
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,122 @@
+package sqlitebackup
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/caasmo/restinpieces/db"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// insertEvents inserts events with the ids in [from, to] into the
+// database at path, creating the table if needed.
+func insertEvents(t *testing.T, path string, from, to int) {
+	t.Helper()
+	conn, err := sqlite.OpenConn(path, sqlite.OpenCreate|sqlite.OpenReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	script := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS events (id INTEGER PRIMARY KEY, body TEXT NOT NULL);
+		WITH RECURSIVE n(i) AS (SELECT %d UNION ALL SELECT i + 1 FROM n WHERE i < %d)
+		INSERT INTO events SELECT i, 'event ' || i FROM n;`, from, to)
+	if err := sqlitex.ExecuteScript(conn, script, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readEvents returns the events of the database at path as "id body",
+// ordered by id.
+func readEvents(t *testing.T, path string) []string {
+	t.Helper()
+	conn, err := sqlite.OpenConn(path, sqlite.OpenReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var events []string
+	err = sqlitex.Execute(conn, "SELECT id, body FROM events ORDER BY id;", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			events = append(events, fmt.Sprintf("%d %s", stmt.ColumnInt64(0), stmt.ColumnText(1)))
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func TestExportRestoresRows(t *testing.T) {
+	dir := t.TempDir()
+	sourcePath := filepath.Join(dir, "app.db")
+	restoredPath := filepath.Join(dir, "restored.db")
+
+	// Each export adds the rows inserted since the previous one
+	batches := []struct{ from, to int }{{1, 3}, {4, 5}, {6, 10}}
+	for i, batch := range batches {
+		insertEvents(t, sourcePath, batch.from, batch.to)
+
+		// Exports of the same second would share a name
+		backupDir := filepath.Join(dir, fmt.Sprintf("backups-%d", i))
+		cfg := Config{
+			SourcePath:      sourcePath,
+			BackupDir:       backupDir,
+			Strategy:        StrategyExport,
+			Compression:     CompressionGzip,
+			Manifest:        true,
+			ExportTable:     "events",
+			ExportColumn:    "id",
+			ExportStateFile: filepath.Join(dir, "export.json"),
+		}
+		if err := NewHandler(&cfg, discardLogger()).Handle(context.Background(), db.Job{}); err != nil {
+			t.Fatal(err)
+		}
+		exports, err := filepath.Glob(filepath.Join(backupDir, "app-*-export.bck.gz"))
+		if err != nil || len(exports) != 1 {
+			t.Fatalf("got exports %q, %v, want one", exports, err)
+		}
+
+		manifest, err := ReadManifest(exports[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if manifest.Export == nil || manifest.Export.Rows != int64(batch.to-batch.from+1) {
+			t.Fatalf("got export range %+v, want the %d rows of batch %d", manifest.Export, batch.to-batch.from+1, i)
+		}
+
+		exportPath := filepath.Join(dir, fmt.Sprintf("export-%d.db", i))
+		if err := DecompressFile(exports[0], exportPath); err != nil {
+			t.Fatal(err)
+		}
+		applyExport(t, restoredPath, exportPath)
+	}
+
+	want := readEvents(t, sourcePath)
+	if got := readEvents(t, restoredPath); !slices.Equal(got, want) {
+		t.Errorf("restored events %q, want %q", got, want)
+	}
+}
+
+// applyExport adds the rows of the export at exportPath to the database
+// at path, the first export becomes the database.
+func applyExport(t *testing.T, path, exportPath string) {
+	t.Helper()
+	conn, err := sqlite.OpenConn(path, sqlite.OpenCreate|sqlite.OpenReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := sqlitex.Execute(conn, "ATTACH DATABASE ? AS export;", &sqlitex.ExecOptions{Args: []any{exportPath}}); err != nil {
+		t.Fatal(err)
+	}
+	script := `CREATE TABLE IF NOT EXISTS main.events (id INTEGER PRIMARY KEY, body TEXT NOT NULL);
+		INSERT INTO main.events SELECT * FROM export.events;`
+	if err := sqlitex.ExecuteScript(conn, script, nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,197 @@
+package sqlitebackup
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimestampLayout is the layout of the timestamp embedded in backup
+// filenames. It sorts lexically in chronological order.
+const TimestampLayout = "2006-01-02T15-04-05Z"
+
+// ZonedTimestampLayout is the layout used when Config.FilenameTimezone is
+// not UTC. The UTC offset makes the name unambiguous, but names only sort
+// chronologically while the offset does not change, e.g. not across a
+// DST switch.
+const ZonedTimestampLayout = "2006-01-02T15-04-05-0700"
+
+const (
+	// FilenameSchemeTimestamp names backups with a readable timestamp,
+	// TimestampLayout or ZonedTimestampLayout. It is the default.
+	FilenameSchemeTimestamp = "timestamp"
+	// FilenameSchemeReverse names backups with a reverse timestamp,
+	// "r" followed by reverseTimestampBase minus the unix time in ten
+	// digits, e.g. app-r8248431599-online.bck.gz. An ascending sort of
+	// the names of a database lists the newest backup first.
+	FilenameSchemeReverse = "reverse"
+)
+
+// reverseTimestampBase is the number FilenameSchemeReverse subtracts the
+// unix time from. The names stay fixed width until the year 2286.
+const reverseTimestampBase = 9999999999
+
+// BackupFile is the parsed form of a backup filename,
+// <database>-<timestamp>-<strategy><extension>.
+type BackupFile struct {
+	Name      string
+	Database  string
+	Time      time.Time
+	Strategy  string
+	Extension string
+}
+
+// backupExtensions lists every extension of a finished backup file.
+func backupExtensions() []string {
+	var exts []string
+	for _, base := range []string{BackupExtension, ArchiveExtension} {
+		for _, ext := range []string{"", ".gz", ".zst"} {
+			exts = append(exts, base+ext, base+ext+EncryptionExtension)
+		}
+	}
+	return exts
+}
+
+// formatBackupFilename builds the filename of a backup, with the timestamp
+// in the location of t.
+func formatBackupFilename(database string, t time.Time, strategy, extension string) string {
+	layout := TimestampLayout
+	if t.Location() != time.UTC {
+		layout = ZonedTimestampLayout
+	}
+	return fmt.Sprintf("%s-%s-%s%s", database, t.Format(layout), strategy, extension)
+}
+
+// formatReverseTimestamp returns the FilenameSchemeReverse timestamp of t.
+func formatReverseTimestamp(t time.Time) string {
+	return fmt.Sprintf("r%010d", reverseTimestampBase-t.Unix())
+}
+
+// parseReverseTimestamp parses a FilenameSchemeReverse timestamp. It
+// reports false if s is not one.
+func parseReverseTimestamp(s string) (time.Time, bool) {
+	digits, ok := strings.CutPrefix(s, "r")
+	if !ok || len(digits) != 10 {
+		return time.Time{}, false
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(reverseTimestampBase-n, 0).UTC(), true
+}
+
+// backupFilename builds the filename of a backup started at t, following
+// Config.FilenameScheme.
+func (h *Handler) backupFilename(database string, t time.Time, strategy, extension string) (string, error) {
+	switch h.cfg.FilenameScheme {
+	case "", FilenameSchemeTimestamp:
+		loc, err := h.filenameLocation()
+		if err != nil {
+			return "", err
+		}
+		return formatBackupFilename(database, t.In(loc), strategy, extension), nil
+	case FilenameSchemeReverse:
+		return fmt.Sprintf("%s-%s-%s%s", database, formatReverseTimestamp(t), strategy, extension), nil
+	default:
+		return "", fmt.Errorf("unknown filename scheme: %q", h.cfg.FilenameScheme)
+	}
+}
+
+// filenameLocation returns the location of the filename timestamps.
+func (h *Handler) filenameLocation() (*time.Location, error) {
+	if h.cfg.FilenameTimezone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(h.cfg.FilenameTimezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filename_timezone: %w", err)
+	}
+	return loc, nil
+}
+
+// ParseBackupFilename parses a filename produced by the backup Handler.
+func ParseBackupFilename(name string) (BackupFile, error) {
+	bf := BackupFile{Name: name}
+
+	stem := ""
+	for _, ext := range backupExtensions() {
+		if s, ok := strings.CutSuffix(name, ext); ok && len(ext) > len(bf.Extension) {
+			stem, bf.Extension = s, ext
+		}
+	}
+	if bf.Extension == "" {
+		return bf, fmt.Errorf("not a backup file: %q", name)
+	}
+
+	i := strings.LastIndex(stem, "-")
+	if i < 0 {
+		return bf, fmt.Errorf("backup filename %q has no strategy", name)
+	}
+	stem, bf.Strategy = stem[:i], stem[i+1:]
+
+	if i := strings.LastIndex(stem, "-"); i > 0 {
+		if t, ok := parseReverseTimestamp(stem[i+1:]); ok {
+			bf.Database, bf.Time = stem[:i], t
+			return bf, nil
+		}
+	}
+
+	layout := TimestampLayout
+	if !strings.HasSuffix(stem, "Z") {
+		layout = ZonedTimestampLayout
+	}
+	if len(stem) < len(layout)+2 || stem[len(stem)-len(layout)-1] != '-' {
+		return bf, fmt.Errorf("backup filename %q has no timestamp", name)
+	}
+	timestamp := stem[len(stem)-len(layout):]
+	bf.Database = stem[:len(stem)-len(layout)-1]
+
+	t, err := time.Parse(layout, timestamp)
+	if err != nil {
+		return bf, fmt.Errorf("backup filename %q has an invalid timestamp: %w", name, err)
+	}
+	bf.Time = t
+
+	return bf, nil
+}
+
+// ListBackups returns the backup files in dir. Sidecars, files still being
+// written and files not named by the Handler are ignored.
+func ListBackups(dir string) ([]BackupFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backup directory: %w", err)
+	}
+
+	var files []BackupFile
+	for _, entry := range entries {
+		if entry.IsDir() || !IsBackupFile(entry.Name()) {
+			continue
+		}
+		bf, err := ParseBackupFilename(entry.Name())
+		if err != nil {
+			continue
+		}
+		files = append(files, bf)
+	}
+	return files, nil
+}
+
+// LatestBackup returns the newest of files, only considering backups of
+// database if it is not empty. It reports false if there is none.
+func LatestBackup(files []BackupFile, database string) (BackupFile, bool) {
+	var latest BackupFile
+	found := false
+	for _, f := range files {
+		if database != "" && f.Database != database {
+			continue
+		}
+		if !found || f.Time.After(latest.Time) {
+			latest, found = f, true
+		}
+	}
+	return latest, found
+}
@@ -0,0 +1,147 @@
+package sqlitebackup
+
+import (
+	"testing"
+	"time"
+	// The zoned names do not depend on the time zone database of the host
+	_ "time/tzdata"
+)
+
+func TestParseBackupFilename(t *testing.T) {
+	berlin := time.FixedZone("CEST", 2*60*60)
+	newYork := time.FixedZone("EST", -5*60*60)
+
+	tests := []struct {
+		name         string
+		wantDatabase string
+		wantTime     time.Time
+		wantStrategy string
+		wantExt      string
+		wantErr      bool
+	}{
+		{
+			name:         "app-2025-07-01T10-30-00Z-online.bck.gz",
+			wantDatabase: "app",
+			wantTime:     time.Date(2025, 7, 1, 10, 30, 0, 0, time.UTC),
+			wantStrategy: StrategyOnline,
+			wantExt:      ".bck.gz",
+		},
+		{
+			name:         "my-app-2025-07-01T10-30-00Z-vacuum.bck.zst.age",
+			wantDatabase: "my-app",
+			wantTime:     time.Date(2025, 7, 1, 10, 30, 0, 0, time.UTC),
+			wantStrategy: StrategyVacuum,
+			wantExt:      ".bck.zst.age",
+		},
+		{
+			name:         "app-2025-07-01T10-30-00Z-forensic.tar.gz",
+			wantDatabase: "app",
+			wantTime:     time.Date(2025, 7, 1, 10, 30, 0, 0, time.UTC),
+			wantStrategy: StrategyForensic,
+			wantExt:      ".tar.gz",
+		},
+		{
+			name:         "app-2025-07-01T12-30-00+0200-online.bck.gz",
+			wantDatabase: "app",
+			wantTime:     time.Date(2025, 7, 1, 12, 30, 0, 0, berlin),
+			wantStrategy: StrategyOnline,
+			wantExt:      ".bck.gz",
+		},
+		{
+			name:         "app-2025-07-01T05-30-00-0500-online.bck.gz",
+			wantDatabase: "app",
+			wantTime:     time.Date(2025, 7, 1, 5, 30, 0, 0, newYork),
+			wantStrategy: StrategyOnline,
+			wantExt:      ".bck.gz",
+		},
+		{
+			name:         "my-app-2025-07-01T07-00-00-0330-online.bck",
+			wantDatabase: "my-app",
+			wantTime:     time.Date(2025, 7, 1, 10, 30, 0, 0, time.UTC),
+			wantStrategy: StrategyOnline,
+			wantExt:      ".bck",
+		},
+		{
+			// 9999999999 - 8248634199 is 2025-07-01T10:30:00Z
+			name:         "app-r8248634199-online.bck.gz",
+			wantDatabase: "app",
+			wantTime:     time.Date(2025, 7, 1, 10, 30, 0, 0, time.UTC),
+			wantStrategy: StrategyOnline,
+			wantExt:      ".bck.gz",
+		},
+		{
+			name:         "my-app-r8248634199-online.bck",
+			wantDatabase: "my-app",
+			wantTime:     time.Date(2025, 7, 1, 10, 30, 0, 0, time.UTC),
+			wantStrategy: StrategyOnline,
+			wantExt:      ".bck",
+		},
+		{name: "app-2025-07-01T10-30-00Z-online.json", wantErr: true},
+		{name: "app.bck.gz", wantErr: true},
+		{name: "app-online.bck.gz", wantErr: true},
+		{name: "app-2025-13-01T10-30-00Z-online.bck.gz", wantErr: true},
+		{name: "2025-07-01T10-30-00Z-online.bck.gz", wantErr: true},
+		{name: "app-2025-07-01T12-30-00+02-online.bck.gz", wantErr: true},
+		{name: "app-2025-07-01T12-30-00+02:00-online.bck.gz", wantErr: true},
+		{name: "app-2025-07-01T05-30-00-05-online.bck.gz", wantErr: true},
+		{name: "app-2025-07-01T05-30-00-05x0-online.bck.gz", wantErr: true},
+		{name: "app-2025-07-01T12-30-00 0200-online.bck.gz", wantErr: true},
+		{name: "2025-07-01T05-30-00-0500-online.bck.gz", wantErr: true},
+		{name: "app-r824843159-online.bck.gz", wantErr: true},
+		{name: "app-r82486341999-online.bck.gz", wantErr: true},
+		{name: "app-rabcdefghij-online.bck.gz", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bf, err := ParseBackupFilename(tt.name)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parsed invalid name as %+v", bf)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bf.Database != tt.wantDatabase || bf.Strategy != tt.wantStrategy || bf.Extension != tt.wantExt {
+				t.Errorf("got database %q, strategy %q, extension %q, want %q, %q, %q", bf.Database, bf.Strategy, bf.Extension, tt.wantDatabase, tt.wantStrategy, tt.wantExt)
+			}
+			if !bf.Time.Equal(tt.wantTime) {
+				t.Errorf("got time %v, want %v", bf.Time, tt.wantTime)
+			}
+		})
+	}
+}
+
+func TestBackupFilenameRoundTrip(t *testing.T) {
+	startedAt := time.Date(2025, 7, 1, 10, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{"timestamp", Config{}, "app-2025-07-01T10-30-00Z-online.bck.gz"},
+		{"reverse", Config{FilenameScheme: FilenameSchemeReverse}, "app-r8248634199-online.bck.gz"},
+		{"zoned", Config{FilenameTimezone: "Etc/GMT+5"}, "app-2025-07-01T05-30-00-0500-online.bck.gz"},
+		{"zoned east", Config{FilenameTimezone: "Etc/GMT-2"}, "app-2025-07-01T12-30-00+0200-online.bck.gz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, err := NewHandler(&tt.cfg, discardLogger()).backupFilename("app", startedAt, StrategyOnline, ".bck.gz")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != tt.want {
+				t.Errorf("got %q, want %q", name, tt.want)
+			}
+			bf, err := ParseBackupFilename(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bf.Time.Equal(startedAt) {
+				t.Errorf("got time %v, want %v", bf.Time, startedAt)
+			}
+		})
+	}
+}
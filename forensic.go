@@ -0,0 +1,197 @@
+package sqlitebackup
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// StrategyForensic captures the on-disk state of the database, the main
+// file together with its -wal and -shm files, into a tar archive.
+//
+// Consistency model: the files are copied while the job holds the write
+// lock of the source (BEGIN IMMEDIATE), so no writer can commit during the
+// copy. Readers are not blocked. A checkpoint run by another connection may
+// still copy WAL frames into the main file during the copy; this is
+// harmless because those frames remain in the WAL and are replayed when
+// the restored triple is opened. The write lock requires read-write access
+// to the source, and writers block for the whole copy.
+const StrategyForensic = "forensic"
+
+// ArchiveExtension is the extension of a forensic backup archive, the
+// codec extension is appended to it.
+const ArchiveExtension = ".tar"
+
+// forensicSuffixes are the database files captured by the forensic strategy.
+var forensicSuffixes = []string{"", "-wal", "-shm"}
+
+// forensicArchive writes the source database files into a tar archive at
+// destPath while holding the write lock of the source.
+func (h *Handler) forensicArchive(ctx context.Context, sourcePath, destPath string) error {
+	conn, err := sqlite.OpenConn(sourcePath, sqlite.OpenReadWrite)
+	if err != nil {
+		return fmt.Errorf("failed to open source db for forensic backup: %w", err)
+	}
+	defer conn.Close()
+	conn.SetInterrupt(ctx.Done())
+
+	if err := sqlitex.ExecuteTransient(conn, "BEGIN IMMEDIATE;", nil); err != nil {
+		return fmt.Errorf("failed to acquire write lock on source db: %w", err)
+	}
+	defer sqlitex.ExecuteTransient(conn, "ROLLBACK;", nil)
+	h.logger.Info("Acquired write lock on source database for forensic copy")
+
+	destFile, err := os.Create(destPath)
+	if err != nil {
+		return fmt.Errorf("failed to create forensic archive: %w", err)
+	}
+	defer destFile.Close()
+
+	tw := tar.NewWriter(destFile)
+	baseName := filepath.Base(sourcePath)
+
+	for _, suffix := range forensicSuffixes {
+		if err := addFileToTar(tw, sourcePath+suffix, baseName+suffix); err != nil {
+			if os.IsNotExist(err) && suffix != "" {
+				h.logger.Info("Database file not present, not archived", "path", sourcePath+suffix)
+				continue
+			}
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to finish forensic archive: %w", err)
+	}
+	return nil
+}
+
+// addFileToTar appends the file at path to the archive under name.
+func addFileToTar(tw *tar.Writer, path, name string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %q: %w", path, err)
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return fmt.Errorf("failed to create tar header for %q: %w", path, err)
+	}
+	header.Name = name
+
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write tar header for %q: %w", path, err)
+	}
+	if _, err := io.CopyN(tw, file, info.Size()); err != nil {
+		return fmt.Errorf("failed to archive %q: %w", path, err)
+	}
+	return nil
+}
+
+// IsArchive reports whether the backup file is a forensic archive.
+func IsArchive(backupPath string) bool {
+	name := strings.TrimSuffix(filepath.Base(backupPath), EncryptionExtension)
+	for _, ext := range []string{"", ".gz", ".zst"} {
+		if strings.HasSuffix(name, ArchiveExtension+ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// RestoreArchive extracts a forensic archive so that the main database is
+// written to destPath and its -wal and -shm files next to it. It fails if
+// the archive does not contain the main database, or contains anything
+// else than the database triple. Encrypted archives are decrypted with the
+// given identities.
+func RestoreArchive(archivePath, destPath string, identities ...age.Identity) error {
+	return restoreArchive(archivePath, destPath, identities, 0)
+}
+
+// restoreArchive is RestoreArchive also checking the size of the
+// decompressed archive against expectedSize, see checkSize.
+func restoreArchive(archivePath, destPath string, identities []age.Identity, expectedSize int64) error {
+	reader, err := openDecompressed(archivePath, identities)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	counter := &countingReader{r: reader}
+	tr := tar.NewReader(counter)
+	var mainName string
+	restored := make(map[string]bool)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read forensic archive: %w", err)
+		}
+
+		// The main database is always the first member
+		if mainName == "" {
+			mainName = header.Name
+		}
+
+		suffix, ok := strings.CutPrefix(header.Name, mainName)
+		if !ok || !isForensicSuffix(suffix) || restored[suffix] {
+			return fmt.Errorf("unexpected member %q in forensic archive", header.Name)
+		}
+
+		if err := extractTarFile(tr, destPath+suffix); err != nil {
+			return err
+		}
+		restored[suffix] = true
+	}
+
+	if !restored[""] {
+		return fmt.Errorf("forensic archive does not contain a database")
+	}
+	// The tar reader stops at the end-of-archive marker, the padding
+	// after it counts towards the size
+	if _, err := io.Copy(io.Discard, counter); err != nil {
+		return fmt.Errorf("failed to read forensic archive: %w", err)
+	}
+	return checkSize(expectedSize, counter.n)
+}
+
+// isForensicSuffix reports whether suffix names one of the archived files.
+func isForensicSuffix(suffix string) bool {
+	for _, s := range forensicSuffixes {
+		if s == suffix {
+			return true
+		}
+	}
+	return false
+}
+
+// extractTarFile writes the current archive member to destPath.
+func extractTarFile(tr *tar.Reader, destPath string) error {
+	destFile, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %q: %w", destPath, err)
+	}
+	defer destFile.Close()
+
+	if _, err := io.Copy(destFile, tr); err != nil {
+		return fmt.Errorf("failed to extract %q: %w", destPath, err)
+	}
+	return nil
+}
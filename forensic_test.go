@@ -0,0 +1,77 @@
+package sqlitebackup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/caasmo/restinpieces/db"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestRestoreArchiveReplaysWAL(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		cfg        Config
+		identities []age.Identity
+	}{
+		{"gzip", Config{Compression: CompressionGzip}, nil},
+		{"zstd", Config{Compression: CompressionZstd}, nil},
+		{"none", Config{Compression: CompressionNone}, nil},
+		{"encrypted zstd", Config{Compression: CompressionZstd, AgeRecipients: []string{identity.Recipient().String()}}, []age.Identity{identity}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sourcePath := filepath.Join(dir, "app.db")
+			// The rows are committed to the WAL only, the connection stays
+			// open so they are not checkpointed into the main file
+			growWAL(t, openWALDatabase(t, sourcePath))
+
+			cfg := tt.cfg
+			cfg.SourcePath = sourcePath
+			cfg.BackupDir = filepath.Join(dir, "backups")
+			cfg.Strategy = StrategyForensic
+			if err := NewHandler(&cfg, discardLogger()).Handle(context.Background(), db.Job{}); err != nil {
+				t.Fatal(err)
+			}
+			archives, err := filepath.Glob(filepath.Join(cfg.BackupDir, "app-*-forensic"+ArchiveExtension+"*"))
+			if err != nil || len(archives) != 1 {
+				t.Fatalf("got archives %q, %v, want one", archives, err)
+			}
+
+			restoredPath := filepath.Join(dir, "restored", "app.db")
+			if err := os.Mkdir(filepath.Dir(restoredPath), 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := RestoreArchive(archives[0], restoredPath, tt.identities...); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(restoredPath + "-wal"); err != nil {
+				t.Fatalf("WAL not restored: %v", err)
+			}
+
+			conn, err := sqlite.OpenConn(restoredPath, sqlite.OpenReadOnly)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			count, err := sqlitex.ResultInt(conn.Prep("SELECT count(*) FROM t;"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// One row from openWALDatabase and 1000 from growWAL
+			if count != 1001 {
+				t.Errorf("got %d rows in the restored database, want 1001", count)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package sqlitebackup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/caasmo/restinpieces/db"
+	"github.com/google/uuid"
+)
+
+// JobTypeDbBackup is the job type the backup Handler is registered for.
+const JobTypeDbBackup = "db_backup"
+
+// Reasons a backup runs, recorded in its manifest and logs for audit.
+// Any other reason, e.g. the name of a release, is accepted as well.
+const (
+	// ReasonScheduled is the reason of jobs without one, e.g. the
+	// recurrent backup job.
+	ReasonScheduled = "scheduled"
+	// ReasonManual is the reason of Backup calls without one.
+	ReasonManual       = "manual"
+	ReasonPreMigration = "pre-migration"
+)
+
+// JobPayload is the payload of a backup job. Only Scope is stored in
+// db.Job.Payload, which the queue keeps unique per job type, finished
+// jobs included. Reason and Labels are stored in db.Job.PayloadExtra, so
+// jobs differing only in them are not distinct jobs.
+type JobPayload struct {
+	// Reason is why the backup runs, e.g. ReasonPreMigration. Empty for
+	// ReasonScheduled.
+	Reason string `json:"reason,omitempty"`
+
+	// Labels annotate the backup, e.g. release=v2.3.1, and are stored
+	// in its manifest.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Scope is the config scope of the backup, see ScopeRouter. Empty
+	// for ScopeDbBackup.
+	Scope string `json:"scope,omitempty"`
+}
+
+// jobKey is the part of a backup job stored in db.Job.Payload.
+type jobKey struct {
+	Scope string `json:"scope,omitempty"`
+	// OneOff is a fresh id of a non-recurrent job, so a one-off backup
+	// collides neither with the recurrent job of its scope nor with
+	// earlier one-off backups.
+	OneOff string `json:"one_off,omitempty"`
+}
+
+// parseJobPayload decodes the payload of a backup job, the scope from
+// db.Job.Payload and the reason and labels from db.Job.PayloadExtra. Jobs
+// of earlier releases hold all of them in Payload. Jobs inserted without
+// a payload have none.
+func parseJobPayload(job db.Job) (JobPayload, error) {
+	var payload JobPayload
+	for _, raw := range []json.RawMessage{job.Payload, job.PayloadExtra} {
+		if len(raw) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(raw, &payload); err != nil {
+			return payload, fmt.Errorf("failed to parse backup job payload: %w", err)
+		}
+	}
+	return payload, nil
+}
+
+// ScheduleBackupJob inserts a backup job into the job queue, first run at
+// start. A recurrent job is rescheduled every interval by the framework.
+func ScheduleBackupJob(queue db.DbQueue, interval time.Duration, start time.Time, recurrent bool) error {
+	return ScheduleBackupJobWithLabels(queue, interval, start, recurrent, nil)
+}
+
+// ScheduleBackupJobWithLabels is ScheduleBackupJob for backups annotated
+// with labels, e.g. a one-off backup before a migration.
+func ScheduleBackupJobWithLabels(queue db.DbQueue, interval time.Duration, start time.Time, recurrent bool, labels map[string]string) error {
+	return ScheduleBackupJobWithPayload(queue, interval, start, recurrent, JobPayload{Labels: labels})
+}
+
+// ScheduleBackupJobWithPayload is ScheduleBackupJob with a full payload,
+// e.g. to name the config scope of the backup.
+func ScheduleBackupJobWithPayload(queue db.DbQueue, interval time.Duration, start time.Time, recurrent bool, jobPayload JobPayload) error {
+	if recurrent && interval <= 0 {
+		return fmt.Errorf("recurrent backup job needs a positive interval, but was %v", interval)
+	}
+
+	key := jobKey{Scope: jobPayload.Scope}
+	if !recurrent {
+		key.OneOff = uuid.NewString()
+	}
+	payload, err := json.Marshal(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	extra, err := json.Marshal(JobPayload{Reason: jobPayload.Reason, Labels: jobPayload.Labels})
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	job := db.Job{
+		JobType:      JobTypeDbBackup,
+		Payload:      payload,
+		PayloadExtra: extra,
+		ScheduledFor: start,
+		Recurrent:    recurrent,
+		Interval:     interval,
+	}
+
+	if err := queue.InsertJob(job); err != nil {
+		return fmt.Errorf("failed to insert backup job: %w", err)
+	}
+	return nil
+}
+
+// ScopeRouter runs backup jobs of several backup configs, each stored
+// under its own config scope. A job runs with the handler of the scope in
+// its payload, jobs without one with the handler of ScopeDbBackup.
+// Register it for JobTypeDbBackup instead of a single Handler. The queue
+// treats jobs with different payloads as distinct, so every scope can
+// have its own recurrent job.
+type ScopeRouter struct {
+	handlers map[string]*Handler
+}
+
+// NewScopeRouter creates a ScopeRouter with the handler of every scope.
+func NewScopeRouter(handlers map[string]*Handler) *ScopeRouter {
+	return &ScopeRouter{handlers: handlers}
+}
+
+// Handle runs job with the handler of its scope.
+func (r *ScopeRouter) Handle(ctx context.Context, job db.Job) error {
+	payload, err := parseJobPayload(job)
+	if err != nil {
+		return err
+	}
+	scope := payload.Scope
+	if scope == "" {
+		scope = ScopeDbBackup
+	}
+	h, ok := r.handlers[scope]
+	if !ok {
+		return fmt.Errorf("no backup handler for config scope %q", scope)
+	}
+	return h.Handle(ctx, job)
+}
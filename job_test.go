@@ -0,0 +1,144 @@
+package sqlitebackup
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caasmo/restinpieces/db"
+)
+
+// uniqueQueue is a db.DbQueue keeping every inserted job and rejecting
+// duplicates of UNIQUE(payload, job_type) like the framework's queue.
+type uniqueQueue struct {
+	jobs []db.Job
+}
+
+func (q *uniqueQueue) InsertJob(job db.Job) error {
+	for _, j := range q.jobs {
+		if j.JobType == job.JobType && string(j.Payload) == string(job.Payload) {
+			return errors.New("UNIQUE constraint failed: job_queue.payload, job_queue.job_type")
+		}
+	}
+	q.jobs = append(q.jobs, job)
+	return nil
+}
+
+func (q *uniqueQueue) Claim(limit int) ([]*db.Job, error)                   { return nil, nil }
+func (q *uniqueQueue) MarkCompleted(jobID int64) error                      { return nil }
+func (q *uniqueQueue) MarkFailed(jobID int64, errMsg string) error          { return nil }
+func (q *uniqueQueue) MarkRecurrentCompleted(jobID int64, job db.Job) error { return nil }
+
+func TestScheduleBackupJob(t *testing.T) {
+	start := time.Date(2025, 7, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		interval  time.Duration
+		recurrent bool
+		wantErr   bool
+	}{
+		{"recurrent", 24 * time.Hour, true, false},
+		{"recurrent without interval", 0, true, true},
+		{"recurrent with negative interval", -time.Hour, true, true},
+		{"one-shot", 0, false, false},
+		{"one-shot with interval", time.Hour, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := &uniqueQueue{}
+			err := ScheduleBackupJob(queue, tt.interval, start, tt.recurrent)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("scheduling succeeded")
+				}
+				if len(queue.jobs) != 0 {
+					t.Errorf("inserted %d jobs, want none", len(queue.jobs))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(queue.jobs) != 1 {
+				t.Fatalf("inserted %d jobs, want 1", len(queue.jobs))
+			}
+			job := queue.jobs[0]
+			if job.JobType != JobTypeDbBackup {
+				t.Errorf("job type %q, want %q", job.JobType, JobTypeDbBackup)
+			}
+			if job.Recurrent != tt.recurrent {
+				t.Errorf("recurrent %v, want %v", job.Recurrent, tt.recurrent)
+			}
+			if job.Interval != tt.interval {
+				t.Errorf("interval %v, want %v", job.Interval, tt.interval)
+			}
+			if !job.ScheduledFor.Equal(start) {
+				t.Errorf("scheduled for %v, want %v", job.ScheduledFor, start)
+			}
+		})
+	}
+}
+
+func TestScheduleBackupJobOneOffJobsAreDistinct(t *testing.T) {
+	queue := &uniqueQueue{}
+	start := time.Date(2025, 7, 1, 10, 0, 0, 0, time.UTC)
+	if err := ScheduleBackupJob(queue, 24*time.Hour, start, true); err != nil {
+		t.Fatalf("recurrent job: %v", err)
+	}
+
+	// One-off jobs with no payload, or the same reason and labels, are
+	// still distinct jobs
+	payloads := []JobPayload{
+		{},
+		{Reason: ReasonPreMigration, Labels: map[string]string{"release": "v2.3.1"}},
+		{Reason: ReasonPreMigration, Labels: map[string]string{"release": "v2.3.1"}},
+	}
+	for i, p := range payloads {
+		if err := ScheduleBackupJobWithPayload(queue, 0, start, false, p); err != nil {
+			t.Fatalf("one-off job %d: %v", i, err)
+		}
+	}
+
+	for i, job := range queue.jobs[1:] {
+		got, err := parseJobPayload(job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, payloads[i]) {
+			t.Errorf("one-off job %d: got payload %+v, want %+v", i, got, payloads[i])
+		}
+	}
+}
+
+func TestParseJobPayload(t *testing.T) {
+	tests := []struct {
+		name string
+		job  db.Job
+		want JobPayload
+	}{
+		{"empty", db.Job{}, JobPayload{}},
+		{"scope only", db.Job{Payload: []byte(`{"scope":"hourly"}`)}, JobPayload{Scope: "hourly"}},
+		{
+			"split",
+			db.Job{Payload: []byte(`{"scope":"hourly","one_off":"x"}`), PayloadExtra: []byte(`{"reason":"manual","labels":{"a":"b"}}`)},
+			JobPayload{Scope: "hourly", Reason: ReasonManual, Labels: map[string]string{"a": "b"}},
+		},
+		{
+			"earlier release",
+			db.Job{Payload: []byte(`{"reason":"manual","labels":{"a":"b"}}`)},
+			JobPayload{Reason: ReasonManual, Labels: map[string]string{"a": "b"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseJobPayload(tt.job)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,452 @@
+package sqlitebackup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A log archive is a single append-only file holding many backups. The
+// format, all integers big endian:
+//
+//	header  "SQBKLOG1"
+//	block   type (1 byte) | payload length (uint64) | payload
+//
+// Blocks follow each other until the end of the file. A record block
+// ('R') holds one backup:
+//
+//	name length (uint16) | name | added at (int64, Unix nanoseconds) |
+//	SHA-256 of the data (32 bytes) | data
+//
+// Every append writes a record followed by an index block ('I') listing
+// all records so far, so the file always ends with the current index:
+//
+//	index as JSON, []LogArchiveEntry | index block offset (uint64) | "SQBKIDX1"
+//
+// The last 16 bytes locate the index without reading the records. Older
+// index blocks stay in the file and are skipped. An append interrupted by
+// a crash leaves bytes after the last index, they are truncated by the
+// next append.
+const (
+	logArchiveMagic  = "SQBKLOG1"
+	logIndexMagic    = "SQBKIDX1"
+	logRecordBlock   = 'R'
+	logIndexBlock    = 'I'
+	logBlockHeader   = 1 + 8
+	logIndexTrailer  = 8 + len(logIndexMagic)
+	logRecordMaxName = 1<<16 - 1
+)
+
+// LogArchiveEntry describes a backup stored in a log archive. Offset and
+// Size locate its data in the archive file.
+type LogArchiveEntry struct {
+	Name    string    `json:"name"`
+	Offset  int64     `json:"offset"`
+	Size    int64     `json:"size"`
+	SHA256  string    `json:"sha256"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// AppendToLogArchive appends the content of r as a backup named name to
+// the log archive at archivePath, creating it if needed.
+func AppendToLogArchive(archivePath, name string, r io.Reader) (LogArchiveEntry, error) {
+	if name == "" || len(name) > logRecordMaxName {
+		return LogArchiveEntry{}, fmt.Errorf("invalid log archive record name %q", name)
+	}
+
+	f, err := os.OpenFile(archivePath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return LogArchiveEntry{}, fmt.Errorf("failed to open log archive: %w", err)
+	}
+	defer f.Close()
+
+	entries, end, err := openLogArchiveForAppend(f)
+	if err != nil {
+		return LogArchiveEntry{}, err
+	}
+
+	entry, err := writeLogRecord(f, end, name, r)
+	if err != nil {
+		// Bytes after the last index are not part of the archive
+		f.Truncate(end)
+		return LogArchiveEntry{}, err
+	}
+	entries = append(entries, entry)
+
+	indexOffset := entry.Offset + entry.Size
+	if err := writeLogIndex(f, indexOffset, entries); err != nil {
+		f.Truncate(end)
+		return LogArchiveEntry{}, err
+	}
+	if err := f.Sync(); err != nil {
+		return LogArchiveEntry{}, fmt.Errorf("failed to sync log archive: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return LogArchiveEntry{}, fmt.Errorf("failed to close log archive: %w", err)
+	}
+	return entry, nil
+}
+
+// openLogArchiveForAppend returns the index of the archive and the offset
+// a new record is written at. A new file gets the header, bytes left after
+// the last index by an interrupted append are truncated.
+func openLogArchiveForAppend(f *os.File) ([]LogArchiveEntry, int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to stat log archive: %w", err)
+	}
+	if info.Size() == 0 {
+		if _, err := f.WriteAt([]byte(logArchiveMagic), 0); err != nil {
+			return nil, 0, fmt.Errorf("failed to write log archive header: %w", err)
+		}
+		return nil, int64(len(logArchiveMagic)), nil
+	}
+
+	entries, err := readLogIndex(f, info.Size())
+	if err == nil {
+		return entries, info.Size(), nil
+	}
+
+	// The file does not end with an index, find the last complete one
+	entries, end, walkErr := walkLogArchive(f, info.Size(), nil)
+	if walkErr != nil {
+		return nil, 0, walkErr
+	}
+	if err := f.Truncate(end); err != nil {
+		return nil, 0, fmt.Errorf("failed to truncate interrupted append: %w", err)
+	}
+	return entries, end, nil
+}
+
+// writeLogRecord writes a record block at offset and returns its entry.
+// The length and checksum are written once the data is copied.
+func writeLogRecord(f *os.File, offset int64, name string, r io.Reader) (LogArchiveEntry, error) {
+	addedAt := time.Now().UTC()
+	var prefix bytes.Buffer
+	prefix.WriteByte(logRecordBlock)
+	binary.Write(&prefix, binary.BigEndian, uint64(0))
+	binary.Write(&prefix, binary.BigEndian, uint16(len(name)))
+	prefix.WriteString(name)
+	binary.Write(&prefix, binary.BigEndian, addedAt.UnixNano())
+	sumOffset := offset + int64(prefix.Len())
+	prefix.Write(make([]byte, sha256.Size))
+
+	if _, err := f.WriteAt(prefix.Bytes(), offset); err != nil {
+		return LogArchiveEntry{}, fmt.Errorf("failed to write log archive record: %w", err)
+	}
+
+	dataOffset := offset + int64(prefix.Len())
+	hash := sha256.New()
+	size, err := io.Copy(io.NewOffsetWriter(f, dataOffset), io.TeeReader(r, hash))
+	if err != nil {
+		return LogArchiveEntry{}, fmt.Errorf("failed to write log archive record data: %w", err)
+	}
+
+	payloadLength := uint64(int64(prefix.Len()) - logBlockHeader + size)
+	if _, err := f.WriteAt(binary.BigEndian.AppendUint64(nil, payloadLength), offset+1); err != nil {
+		return LogArchiveEntry{}, fmt.Errorf("failed to write log archive record length: %w", err)
+	}
+	sum := hash.Sum(nil)
+	if _, err := f.WriteAt(sum, sumOffset); err != nil {
+		return LogArchiveEntry{}, fmt.Errorf("failed to write log archive record checksum: %w", err)
+	}
+
+	return LogArchiveEntry{
+		Name:    name,
+		Offset:  dataOffset,
+		Size:    size,
+		SHA256:  hex.EncodeToString(sum),
+		AddedAt: addedAt,
+	}, nil
+}
+
+// writeLogIndex writes an index block listing entries at offset.
+func writeLogIndex(f *os.File, offset int64, entries []LogArchiveEntry) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("failed to marshal log archive index: %w", err)
+	}
+
+	var block bytes.Buffer
+	block.WriteByte(logIndexBlock)
+	binary.Write(&block, binary.BigEndian, uint64(len(data)+logIndexTrailer))
+	block.Write(data)
+	binary.Write(&block, binary.BigEndian, uint64(offset))
+	block.WriteString(logIndexMagic)
+
+	if _, err := f.WriteAt(block.Bytes(), offset); err != nil {
+		return fmt.Errorf("failed to write log archive index: %w", err)
+	}
+	return nil
+}
+
+// readLogIndex reads the index the archive of the given size ends with.
+func readLogIndex(r io.ReaderAt, size int64) ([]LogArchiveEntry, error) {
+	if size < int64(len(logArchiveMagic)+logBlockHeader+logIndexTrailer) {
+		return nil, fmt.Errorf("log archive has no index")
+	}
+	magic := make([]byte, len(logArchiveMagic))
+	if _, err := r.ReadAt(magic, 0); err != nil || string(magic) != logArchiveMagic {
+		return nil, fmt.Errorf("not a log archive")
+	}
+	trailer := make([]byte, logIndexTrailer)
+	if _, err := r.ReadAt(trailer, size-int64(logIndexTrailer)); err != nil {
+		return nil, fmt.Errorf("failed to read log archive trailer: %w", err)
+	}
+	if string(trailer[8:]) != logIndexMagic {
+		return nil, fmt.Errorf("log archive does not end with an index")
+	}
+
+	indexOffset := int64(binary.BigEndian.Uint64(trailer))
+	if indexOffset < int64(len(logArchiveMagic)) || indexOffset > size-int64(logBlockHeader+logIndexTrailer) {
+		return nil, fmt.Errorf("log archive index offset %d out of range", indexOffset)
+	}
+	data := make([]byte, size-indexOffset-logBlockHeader-int64(logIndexTrailer))
+	header := make([]byte, logBlockHeader)
+	if _, err := r.ReadAt(header, indexOffset); err != nil {
+		return nil, fmt.Errorf("failed to read log archive index: %w", err)
+	}
+	if header[0] != logIndexBlock || binary.BigEndian.Uint64(header[1:]) != uint64(len(data)+logIndexTrailer) {
+		return nil, fmt.Errorf("log archive index block at offset %d is invalid", indexOffset)
+	}
+	if _, err := r.ReadAt(data, indexOffset+logBlockHeader); err != nil {
+		return nil, fmt.Errorf("failed to read log archive index: %w", err)
+	}
+
+	var entries []LogArchiveEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse log archive index: %w", err)
+	}
+	return entries, nil
+}
+
+// walkLogArchive reads every block of the archive from the start. It
+// returns the index of the last complete index block and the offset it
+// ends at; the walk stops at the first incomplete or unknown block. If
+// record is not nil, it is called with the entry and the hash of the data
+// of every record.
+func walkLogArchive(r io.ReaderAt, size int64, record func(LogArchiveEntry, hash.Hash) error) ([]LogArchiveEntry, int64, error) {
+	header := make([]byte, len(logArchiveMagic))
+	if _, err := r.ReadAt(header, 0); err != nil || string(header) != logArchiveMagic {
+		return nil, 0, fmt.Errorf("not a log archive")
+	}
+
+	var entries []LogArchiveEntry
+	end := int64(len(logArchiveMagic))
+	offset := end
+	blockHeader := make([]byte, logBlockHeader)
+	for offset+logBlockHeader <= size {
+		if _, err := r.ReadAt(blockHeader, offset); err != nil {
+			return nil, 0, fmt.Errorf("failed to read log archive block at offset %d: %w", offset, err)
+		}
+		payloadLength := int64(binary.BigEndian.Uint64(blockHeader[1:]))
+		payloadOffset := offset + logBlockHeader
+		if payloadLength < 0 || payloadLength > size-payloadOffset {
+			break
+		}
+		next := payloadOffset + payloadLength
+
+		switch blockHeader[0] {
+		case logRecordBlock:
+			if record != nil {
+				entry, sum, err := readLogRecord(r, payloadOffset, payloadLength)
+				if err != nil {
+					return nil, 0, err
+				}
+				if err := record(entry, sum); err != nil {
+					return nil, 0, err
+				}
+			}
+		case logIndexBlock:
+			index, err := readLogIndex(io.NewSectionReader(r, 0, next), next)
+			if err != nil {
+				return entries, end, nil
+			}
+			entries, end = index, next
+		default:
+			return entries, end, nil
+		}
+		offset = next
+	}
+	return entries, end, nil
+}
+
+// readLogRecord reads the record with the payload at offset and hashes
+// its data.
+func readLogRecord(r io.ReaderAt, offset, length int64) (LogArchiveEntry, hash.Hash, error) {
+	var nameLength uint16
+	section := io.NewSectionReader(r, offset, length)
+	if err := binary.Read(section, binary.BigEndian, &nameLength); err != nil {
+		return LogArchiveEntry{}, nil, fmt.Errorf("failed to read log archive record at offset %d: %w", offset, err)
+	}
+	name := make([]byte, nameLength)
+	var addedAt int64
+	sum := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(section, name); err != nil {
+		return LogArchiveEntry{}, nil, fmt.Errorf("failed to read log archive record at offset %d: %w", offset, err)
+	}
+	if err := binary.Read(section, binary.BigEndian, &addedAt); err != nil {
+		return LogArchiveEntry{}, nil, fmt.Errorf("failed to read log archive record at offset %d: %w", offset, err)
+	}
+	if _, err := io.ReadFull(section, sum); err != nil {
+		return LogArchiveEntry{}, nil, fmt.Errorf("failed to read log archive record at offset %d: %w", offset, err)
+	}
+
+	dataOffset := offset + 2 + int64(nameLength) + 8 + sha256.Size
+	hash := sha256.New()
+	if _, err := io.Copy(hash, section); err != nil {
+		return LogArchiveEntry{}, nil, fmt.Errorf("failed to read log archive record %q: %w", name, err)
+	}
+	return LogArchiveEntry{
+		Name:    string(name),
+		Offset:  dataOffset,
+		Size:    offset + length - dataOffset,
+		SHA256:  hex.EncodeToString(sum),
+		AddedAt: time.Unix(0, addedAt).UTC(),
+	}, hash, nil
+}
+
+// ListLogArchive returns the backups in the log archive, oldest first.
+// Bytes left by an interrupted append are ignored.
+func ListLogArchive(archivePath string) ([]LogArchiveEntry, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log archive: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat log archive: %w", err)
+	}
+	entries, err := readLogIndex(f, info.Size())
+	if err == nil {
+		return entries, nil
+	}
+	entries, end, walkErr := walkLogArchive(f, info.Size(), nil)
+	if walkErr != nil {
+		return nil, walkErr
+	}
+	if end == int64(len(logArchiveMagic)) {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ExtractFromLogArchive writes the data of the newest backup named name
+// to w. The checksum is verified, so w has received corrupt data if an
+// error is returned.
+func ExtractFromLogArchive(archivePath, name string, w io.Writer) error {
+	entries, err := ListLogArchive(archivePath)
+	if err != nil {
+		return err
+	}
+	var entry *LogArchiveEntry
+	for i := range entries {
+		if entries[i].Name == name {
+			entry = &entries[i]
+		}
+	}
+	if entry == nil {
+		return fmt.Errorf("backup %q not found in log archive", name)
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open log archive: %w", err)
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, hash), io.NewSectionReader(f, entry.Offset, entry.Size)); err != nil {
+		return fmt.Errorf("failed to extract %q from log archive: %w", name, err)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != entry.SHA256 {
+		return fmt.Errorf("checksum mismatch for %q: expected %s, got %s", name, entry.SHA256, sum)
+	}
+	return nil
+}
+
+// CheckLogArchive verifies a whole log archive: the checksum of every
+// record, that the file ends with an index, and that the index matches
+// the records.
+func CheckLogArchive(archivePath string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open log archive: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat log archive: %w", err)
+	}
+
+	records := make(map[int64]LogArchiveEntry)
+	var errs []error
+	_, end, err := walkLogArchive(f, info.Size(), func(entry LogArchiveEntry, sum hash.Hash) error {
+		if got := hex.EncodeToString(sum.Sum(nil)); got != entry.SHA256 {
+			errs = append(errs, fmt.Errorf("record %q at offset %d: checksum mismatch: expected %s, got %s", entry.Name, entry.Offset, entry.SHA256, got))
+		}
+		records[entry.Offset] = entry
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if end != info.Size() {
+		errs = append(errs, fmt.Errorf("%d bytes after the last index, an append was interrupted", info.Size()-end))
+	}
+
+	index, err := readLogIndex(f, end)
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	for _, entry := range index {
+		record, ok := records[entry.Offset]
+		if !ok || record.Name != entry.Name || record.Size != entry.Size || record.SHA256 != entry.SHA256 {
+			errs = append(errs, fmt.Errorf("index entry %q at offset %d does not match a record", entry.Name, entry.Offset))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// appendToLogArchive appends the finished backup to Config.LogArchive,
+// named by its filename.
+func (h *Handler) appendToLogArchive(backupPath string) error {
+	f, err := os.Open(backupPath)
+	if err != nil {
+		return fmt.Errorf("failed to open backup for the log archive: %w", err)
+	}
+	defer f.Close()
+
+	// A new archive gets its mode and owner before the first backup is
+	// appended to it
+	if _, err := os.Stat(h.cfg.LogArchive); errors.Is(err, fs.ErrNotExist) {
+		archive, err := h.createFile(h.cfg.LogArchive)
+		if err != nil {
+			return fmt.Errorf("failed to create log archive: %w", err)
+		}
+		archive.Close()
+	}
+
+	entry, err := AppendToLogArchive(h.cfg.LogArchive, filepath.Base(backupPath), f)
+	if err != nil {
+		return err
+	}
+	if err := h.applyPermissions(h.cfg.LogArchive); err != nil {
+		return err
+	}
+	h.logger.Info("Successfully appended backup to log archive", "archive", h.cfg.LogArchive, "name", entry.Name, "offset", entry.Offset, "size", entry.Size)
+	return nil
+}
@@ -0,0 +1,139 @@
+package sqlitebackup
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// appendRecords appends a record for every name to the log archive at
+// path, the data of each is its name repeated, and returns the archive
+// size after each append.
+func appendRecords(t *testing.T, path string, names ...string) []int64 {
+	t.Helper()
+	var sizes []int64
+	for _, name := range names {
+		if _, err := AppendToLogArchive(path, name, bytes.NewReader(recordData(name))); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, info.Size())
+	}
+	return sizes
+}
+
+func recordData(name string) []byte {
+	return bytes.Repeat([]byte(name), 1000)
+}
+
+// checkRecords checks that the log archive at path lists exactly names
+// and that each of them extracts to its data.
+func checkRecords(t *testing.T, path string, names ...string) {
+	t.Helper()
+	entries, err := ListLogArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Name)
+	}
+	if !slices.Equal(got, names) {
+		t.Fatalf("got records %q, want %q", got, names)
+	}
+	for _, name := range names {
+		var buf bytes.Buffer
+		if err := ExtractFromLogArchive(path, name, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), recordData(name)) {
+			t.Errorf("record %q extracted with different data", name)
+		}
+	}
+}
+
+func TestLogArchiveRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backups.log")
+	appendRecords(t, path, "one", "two", "three")
+
+	checkRecords(t, path, "one", "two", "three")
+	if err := CheckLogArchive(path); err != nil {
+		t.Errorf("check of an intact archive failed: %v", err)
+	}
+	if err := ExtractFromLogArchive(path, "four", &bytes.Buffer{}); err == nil {
+		t.Error("extracting a missing record succeeded")
+	}
+}
+
+func TestLogArchiveRecoversInterruptedAppend(t *testing.T) {
+	tests := []struct {
+		name string
+		// cut returns the size the archive is truncated to, given its
+		// size after the first and the second append
+		cut func(first, second int64) int64
+	}{
+		{"mid record header", func(first, second int64) int64 { return first + 5 }},
+		{"mid record data", func(first, second int64) int64 { return first + 500 }},
+		{"mid index", func(first, second int64) int64 { return second - 20 }},
+		{"mid index trailer", func(first, second int64) int64 { return second - 5 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "backups.log")
+			sizes := appendRecords(t, path, "one", "two")
+			// A crash during the second append
+			if err := os.Truncate(path, tt.cut(sizes[0], sizes[1])); err != nil {
+				t.Fatal(err)
+			}
+
+			checkRecords(t, path, "one")
+			if err := CheckLogArchive(path); err == nil || !strings.Contains(err.Error(), "append was interrupted") {
+				t.Errorf("got check error %v, want an interrupted append", err)
+			}
+
+			appendRecords(t, path, "three")
+			checkRecords(t, path, "one", "three")
+			if err := CheckLogArchive(path); err != nil {
+				t.Errorf("check after the recovering append failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestLogArchiveDetectsCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backups.log")
+	appendRecords(t, path, "one")
+	entries, err := ListLogArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a bit in the data of the record
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	offset := entries[0].Offset + entries[0].Size/2
+	if _, err := f.ReadAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0x01
+	if _, err := f.WriteAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if err := CheckLogArchive(path); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("got check error %v, want a checksum mismatch", err)
+	}
+	if err := ExtractFromLogArchive(path, "one", &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("got extract error %v, want a checksum mismatch", err)
+	}
+}
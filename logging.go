@@ -0,0 +1,54 @@
+package sqlitebackup
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// LogOptions is the logging setup shared by the tools in cmd, so the logs
+// of the backup side and the pull side can be read and correlated by the
+// same pipeline. Applications embedding the Handler can build the logger
+// they pass to NewHandler the same way.
+type LogOptions struct {
+	// Format is LogFormatText, the default, or LogFormatJSON.
+	Format string
+	// Level is a slog level name, debug, info (default), warn or error.
+	Level string
+}
+
+// RegisterLogFlags defines the -log-format and -log-level flags on fs and
+// returns the options they are parsed into.
+func RegisterLogFlags(fs *flag.FlagSet) *LogOptions {
+	opts := &LogOptions{}
+	fs.StringVar(&opts.Format, "log-format", LogFormatText, "Log format: text or json")
+	fs.StringVar(&opts.Level, "log-level", "info", "Minimum log level: debug, info, warn or error")
+	return opts
+}
+
+// NewLogger returns a logger writing to w with the format and level of
+// the options.
+func (o LogOptions) NewLogger(w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if o.Level != "" {
+		if err := level.UnmarshalText([]byte(o.Level)); err != nil {
+			return nil, fmt.Errorf("invalid log level %q: %w", o.Level, err)
+		}
+	}
+	handlerOpts := &slog.HandlerOptions{Level: level}
+
+	switch o.Format {
+	case "", LogFormatText:
+		return slog.New(slog.NewTextHandler(w, handlerOpts)), nil
+	case LogFormatJSON:
+		return slog.New(slog.NewJSONHandler(w, handlerOpts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format: %q, expected %s or %s", o.Format, LogFormatText, LogFormatJSON)
+	}
+}
@@ -0,0 +1,81 @@
+package sqlitebackup
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maintenanceTimeLayout is the time of day format of the maintenance
+// window bounds.
+const maintenanceTimeLayout = "15:04"
+
+// weekdays maps the accepted day names to their time.Weekday.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// inMaintenanceWindow reports whether now falls inside the configured
+// maintenance window. Bounds are local times of day, a window whose end is
+// before its start spans midnight. Days, if set, restrict the window to
+// the days it starts on.
+func (h *Handler) inMaintenanceWindow(now time.Time) (bool, error) {
+	if h.cfg.MaintenanceStart == "" && h.cfg.MaintenanceEnd == "" {
+		return false, nil
+	}
+
+	start, err := parseTimeOfDay(h.cfg.MaintenanceStart)
+	if err != nil {
+		return false, fmt.Errorf("invalid maintenance_start: %w", err)
+	}
+	end, err := parseTimeOfDay(h.cfg.MaintenanceEnd)
+	if err != nil {
+		return false, fmt.Errorf("invalid maintenance_end: %w", err)
+	}
+
+	days := make(map[time.Weekday]bool)
+	for _, name := range h.cfg.MaintenanceDays {
+		day, ok := weekdays[strings.ToLower(name)]
+		if !ok {
+			return false, fmt.Errorf("invalid maintenance_days entry %q, expected one of sun, mon, tue, wed, thu, fri, sat", name)
+		}
+		days[day] = true
+	}
+
+	now = now.Local()
+	sinceMidnight := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute + time.Duration(now.Second())*time.Second
+	startDay := now.Weekday()
+
+	var inside bool
+	switch {
+	case start <= end:
+		inside = sinceMidnight >= start && sinceMidnight < end
+	case sinceMidnight >= start:
+		inside = true
+	case sinceMidnight < end:
+		// After midnight, the window started the day before
+		inside = true
+		startDay = (startDay + 6) % 7
+	}
+
+	if inside && len(days) > 0 {
+		inside = days[startDay]
+	}
+	return inside, nil
+}
+
+// parseTimeOfDay parses an HH:MM time of day into the duration since
+// midnight.
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse(maintenanceTimeLayout, value)
+	if err != nil {
+		return 0, fmt.Errorf("expected HH:MM, got %q", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
@@ -0,0 +1,178 @@
+package sqlitebackup
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+)
+
+// ManifestExtension is appended to the backup filename to name its manifest.
+const ManifestExtension = ".json"
+
+// Manifest describes a backup file. It is written as a JSON sidecar next
+// to the backup when Config.Manifest is enabled, and also whenever it holds
+// data kept nowhere else: labels, the reason of a run not scheduled, the
+// wrapped data key of Config.KMSKeyID, the public key of
+// Config.SigningKeyPath, or the page count of Config.MaxPageCountDrop.
+type Manifest struct {
+	RunID            string    `json:"run_id"`
+	BackupFile       string    `json:"backup_file"`
+	Source           string    `json:"source"`
+	Strategy         string    `json:"strategy"`
+	Compression      string    `json:"compression"`
+	CreatedAt        time.Time `json:"created_at"`
+	Size             int64     `json:"size"`
+	UncompressedSize int64     `json:"uncompressed_size"`
+
+	// PageCount is the page count of the source, recorded when
+	// Config.MaxPageCountDrop is set.
+	PageCount int64 `json:"page_count,omitempty"`
+
+	// CapturedAt is when the source was in the state held by the backup.
+	CapturedAt time.Time `json:"captured_at,omitzero"`
+
+	// CompressionSkipped is set when the compressed file did not save
+	// enough space and the backup was stored uncompressed.
+	CompressionSkipped bool    `json:"compression_skipped,omitempty"`
+	CompressionSavings float64 `json:"compression_savings"`
+
+	// Encrypted is set when the backup is encrypted with age.
+	Encrypted bool `json:"encrypted,omitempty"`
+
+	// KMSKeyID and WrappedDataKey are set for envelope encryption, see
+	// UnwrapDataKey.
+	KMSKeyID       string `json:"kms_key_id,omitempty"`
+	WrappedDataKey []byte `json:"wrapped_data_key,omitempty"`
+
+	// SigningPublicKey is the public key of the detached signature, for
+	// reference only, see VerifySignature.
+	SigningPublicKey ed25519.PublicKey `json:"signing_public_key,omitempty"`
+
+	// Reason is why the backup was taken, see JobPayload.Reason. It is
+	// empty in manifests written before it was recorded.
+	Reason string `json:"reason,omitempty"`
+
+	// Labels are the key/value annotations of the job that took the
+	// backup, see JobPayload.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Export describes the rows held by a StrategyExport file.
+	Export *ExportRange `json:"export,omitempty"`
+}
+
+// writeManifest writes the manifest next to the backup file, encrypted if
+// Config.EncryptSidecars is set. It returns the path of the manifest.
+func (h *Handler) writeManifest(backupPath string, m *Manifest) (string, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+
+	manifestPath := strings.TrimSuffix(backupPath, EncryptionExtension) + ManifestExtension
+	if !h.cfg.EncryptSidecars {
+		if err := h.writeFile(manifestPath, append(data, '\n')); err != nil {
+			return "", fmt.Errorf("failed to write manifest: %w", err)
+		}
+		return manifestPath, nil
+	}
+
+	manifestPath += EncryptionExtension
+	out, err := h.createOutput(manifestPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create manifest: %w", err)
+	}
+	defer out.Close()
+	if _, err := out.Write(append(data, '\n')); err != nil {
+		return "", fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return "", fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return manifestPath, nil
+}
+
+// ReadManifest reads the manifest sidecar of a backup file. An encrypted
+// manifest is decrypted with the given identities.
+func ReadManifest(backupPath string, identities ...age.Identity) (*Manifest, error) {
+	manifestPath := strings.TrimSuffix(backupPath, EncryptionExtension) + ManifestExtension
+	data, err := os.ReadFile(manifestPath)
+	if os.IsNotExist(err) {
+		data, err = readEncrypted(manifestPath+EncryptionExtension, identities)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// readEncrypted reads and decrypts an age encrypted file.
+func readEncrypted(path string, identities []age.Identity) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	plain, _, err := openDecrypted(file, path, identities)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(plain)
+}
+
+// OrphanedSidecars returns the names of the manifests, metadata and
+// signature sidecars in dir whose backup file no longer exists, e.g.
+// after it was deleted out-of-band.
+func OrphanedSidecars(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backup directory: %w", err)
+	}
+
+	existing := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		existing[entry.Name()] = true
+	}
+
+	var orphans []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if backup, ok := cutSidecarExtension(name); ok && !entry.IsDir() && IsBackupFile(backup) {
+			if !existing[backup] {
+				orphans = append(orphans, filepath.Join(dir, name))
+			}
+			continue
+		}
+		backup, ok := strings.CutSuffix(strings.TrimSuffix(name, EncryptionExtension), ManifestExtension)
+		if entry.IsDir() || !ok || !IsBackupFile(backup) {
+			continue
+		}
+		// The manifest of an encrypted backup is named without .age
+		if !existing[backup] && !existing[backup+EncryptionExtension] {
+			orphans = append(orphans, filepath.Join(dir, name))
+		}
+	}
+	return orphans, nil
+}
+
+// cutSidecarExtension returns the backup name of a metadata or signature
+// sidecar, both named after the full backup filename.
+func cutSidecarExtension(name string) (string, bool) {
+	for _, ext := range []string{MetaExtension, SignatureExtension} {
+		if backup, ok := strings.CutSuffix(name, ext); ok {
+			return backup, true
+		}
+	}
+	return "", false
+}
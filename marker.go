@@ -0,0 +1,88 @@
+package sqlitebackup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Marker describes the latest successful backup. It is written to
+// Config.MarkerPath so dependent jobs, e.g. replication, can poll it
+// instead of parsing logs.
+type Marker struct {
+	RunID     string    `json:"run_id"`
+	Reason    string    `json:"reason,omitempty"`
+	Path      string    `json:"path"`
+	CreatedAt time.Time `json:"created_at"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+}
+
+// ReadMarker reads the marker file at path.
+func ReadMarker(path string) (*Marker, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read marker: %w", err)
+	}
+	var m Marker
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse marker: %w", err)
+	}
+	return &m, nil
+}
+
+// writeMarker replaces the marker with the metadata of the backup at
+// backupPath. The marker is written next to its final path and renamed
+// into place, so readers never see a partial file.
+func (h *Handler) writeMarker(backupPath string, manifest *Manifest) error {
+	sum, err := fileSHA256(backupPath)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(Marker{
+		RunID:     manifest.RunID,
+		Reason:    manifest.Reason,
+		Path:      backupPath,
+		CreatedAt: manifest.CreatedAt,
+		Size:      manifest.Size,
+		SHA256:    sum,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal marker: %w", err)
+	}
+
+	markerPath := h.cfg.MarkerPath
+	if err := os.MkdirAll(filepath.Dir(markerPath), 0755); err != nil {
+		return fmt.Errorf("failed to create marker directory: %w", err)
+	}
+	inProgressPath := markerPath + h.inProgressSuffix()
+	if err := h.writeFile(inProgressPath, append(data, '\n')); err != nil {
+		os.Remove(inProgressPath)
+		return fmt.Errorf("failed to write marker: %w", err)
+	}
+	if err := os.Rename(inProgressPath, markerPath); err != nil {
+		os.Remove(inProgressPath)
+		return fmt.Errorf("failed to rename marker into place: %w", err)
+	}
+	return h.applyPermissions(markerPath)
+}
+
+// fileSHA256 returns the hex encoded SHA-256 checksum of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %q for checksum: %w", path, err)
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", fmt.Errorf("failed to checksum %q: %w", path, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,63 @@
+package sqlitebackup
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MetaExtension is appended to the backup filename to name its HTTP
+// metadata sidecar, see Config.HTTPMeta.
+const MetaExtension = ".meta"
+
+// Meta holds the headers a static file server needs to serve a backup
+// file. Backups are renamed into place once complete, so the size does
+// not change while they are served.
+type Meta struct {
+	ContentType        string `json:"content_type"`
+	ContentLength      int64  `json:"content_length"`
+	ContentDisposition string `json:"content_disposition"`
+}
+
+// backupContentType returns the media type of the backup file name.
+func backupContentType(name string) string {
+	switch {
+	case strings.HasSuffix(name, EncryptionExtension):
+		return "application/octet-stream"
+	case strings.HasSuffix(name, ".gz"):
+		return "application/gzip"
+	case strings.HasSuffix(name, ".zst"):
+		return "application/zstd"
+	case strings.HasSuffix(name, ArchiveExtension):
+		return "application/x-tar"
+	default:
+		return "application/vnd.sqlite3"
+	}
+}
+
+// writeMeta writes the HTTP metadata sidecar of the backup at backupPath
+// and returns its path.
+func (h *Handler) writeMeta(backupPath string) (string, error) {
+	info, err := os.Stat(backupPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat backup for metadata: %w", err)
+	}
+	name := filepath.Base(backupPath)
+	data, err := json.MarshalIndent(Meta{
+		ContentType:        backupContentType(name),
+		ContentLength:      info.Size(),
+		ContentDisposition: mime.FormatMediaType("attachment", map[string]string{"filename": name}),
+	}, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+
+	metaPath := backupPath + MetaExtension
+	if err := h.writeFile(metaPath, append(data, '\n')); err != nil {
+		return "", fmt.Errorf("failed to write metadata: %w", err)
+	}
+	return metaPath, nil
+}
@@ -0,0 +1,152 @@
+package sqlitebackup
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Stats summarizes the backup runs of a Handler since it was created.
+type Stats struct {
+	TotalRuns      int64     `json:"total_runs"`
+	Failures       int64     `json:"failures"`
+	LastRunAt      time.Time `json:"last_run_at,omitzero"`
+	LastDuration   Duration  `json:"last_duration"`
+	LastSuccessAt  time.Time `json:"last_success_at,omitzero"`
+	LastBackupFile string    `json:"last_backup_file,omitempty"`
+	LastBackupSize int64     `json:"last_backup_size,omitempty"`
+	LastErrorAt    time.Time `json:"last_error_at,omitzero"`
+	LastError      string    `json:"last_error,omitempty"`
+
+	// MirrorFailures counts copies to Config.MirrorDirs that failed,
+	// these do not fail the run.
+	MirrorFailures    int64     `json:"mirror_failures"`
+	LastMirrorErrorAt time.Time `json:"last_mirror_error_at,omitzero"`
+	LastMirrorError   string    `json:"last_mirror_error,omitempty"`
+
+	// DurationP50 and DurationP95 are percentiles of the durations of
+	// the last Config.DurationWindow successful runs.
+	DurationP50 Duration `json:"duration_p50"`
+	DurationP95 Duration `json:"duration_p95"`
+}
+
+// DefaultDurationWindow is the number of recent successful runs the
+// duration percentiles are computed over.
+const DefaultDurationWindow = 20
+
+// minDurationSamples is the number of runs needed before a run is
+// compared with the p95, fewer make the percentile meaningless.
+const minDurationSamples = 5
+
+// metrics records the outcome of backup runs. It is shared by the
+// per-run copies of a Handler.
+type metrics struct {
+	mu    sync.Mutex
+	stats Stats
+
+	// durations of the recent successful runs, oldest first
+	durations []time.Duration
+	window    int
+}
+
+// newMetrics returns metrics keeping the durations of the last window
+// successful runs, DefaultDurationWindow if window is 0 or less.
+func newMetrics(window int) *metrics {
+	if window <= 0 {
+		window = DefaultDurationWindow
+	}
+	return &metrics{window: window}
+}
+
+// record updates the stats with the outcome of a run started at startedAt.
+func (m *metrics) record(startedAt time.Time, manifest *Manifest, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.stats.TotalRuns++
+	m.stats.LastRunAt = startedAt
+	m.stats.LastDuration = Duration{Duration: now.Sub(startedAt)}
+
+	if err != nil {
+		m.stats.Failures++
+		m.stats.LastErrorAt = now
+		m.stats.LastError = err.Error()
+		return
+	}
+
+	m.stats.LastSuccessAt = now
+	// A run without manifest was skipped, its duration says nothing
+	if manifest != nil {
+		m.stats.LastBackupFile = manifest.BackupFile
+		m.stats.LastBackupSize = manifest.Size
+
+		m.durations = append(m.durations, m.stats.LastDuration.Duration)
+		if len(m.durations) > m.window {
+			m.durations = m.durations[len(m.durations)-m.window:]
+		}
+		m.stats.DurationP50 = Duration{Duration: percentile(m.durations, 50)}
+		m.stats.DurationP95 = Duration{Duration: percentile(m.durations, 95)}
+	}
+}
+
+// slowRunThreshold returns the duration above which a run is reported as
+// slow, the p95 of the recent runs times factor. It reports false while
+// there are too few runs or factor is not set.
+func (m *metrics) slowRunThreshold(factor float64) (time.Duration, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if factor <= 0 || len(m.durations) < minDurationSamples {
+		return 0, false
+	}
+	return time.Duration(float64(percentile(m.durations, 95)) * factor), true
+}
+
+// percentile returns the p-th percentile of durations by the nearest-rank
+// method, 0 for no durations.
+func percentile(durations []time.Duration, p float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(durations)
+	slices.Sort(sorted)
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
+
+// recordMirrorFailure counts a failed copy to a mirror directory.
+func (m *metrics) recordMirrorFailure(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stats.MirrorFailures++
+	m.stats.LastMirrorErrorAt = time.Now()
+	m.stats.LastMirrorError = err.Error()
+}
+
+// snapshot returns a copy of the current stats.
+func (m *metrics) snapshot() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+// Stats returns the outcome of the backup runs so far.
+func (h *Handler) Stats() Stats {
+	return h.metrics.snapshot()
+}
+
+// StatusHandler returns an http.Handler serving the Stats as JSON, for
+// monitoring systems to scrape.
+func (h *Handler) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(h.Stats()); err != nil {
+			h.logger.Error("failed to write backup status", "error", err)
+		}
+	})
+}
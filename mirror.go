@@ -0,0 +1,82 @@
+package sqlitebackup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// mirrorBackup copies the finished backup and its manifest to every
+// Config.MirrorDirs directory. A failing mirror is logged and counted in
+// the stats, but neither stops the other mirrors nor fails the job.
+func (h *Handler) mirrorBackup(resolvedSource string, paths ...string) {
+	for _, dir := range h.cfg.MirrorDirs {
+		if err := h.mirrorTo(resolvedSource, dir, paths); err != nil {
+			h.logger.Error("Failed to copy backup to mirror directory", "dir", dir, "error", err)
+			h.metrics.recordMirrorFailure(err)
+			continue
+		}
+		h.logger.Info("Successfully copied backup to mirror directory", "dir", dir)
+	}
+}
+
+// mirrorTo copies paths into dir.
+func (h *Handler) mirrorTo(resolvedSource, dir string, paths []string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create mirror directory: %w", err)
+	}
+	if err := h.applyPermissions(dir); err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		dest := filepath.Join(dir, filepath.Base(path))
+		if err := ensureDistinct(resolvedSource, dest); err != nil {
+			return err
+		}
+		if err := h.copyFile(path, dest); err != nil {
+			return err
+		}
+		if err := h.applyPermissions(dest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies src to an in-progress file next to dest and renames it
+// into place once complete.
+func (h *Handler) copyFile(src, dest string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %q for copying: %w", src, err)
+	}
+	defer srcFile.Close()
+
+	inProgressPath := dest + h.inProgressSuffix()
+	destFile, err := h.createFile(inProgressPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %q: %w", inProgressPath, err)
+	}
+	defer destFile.Close()
+
+	if _, err := io.Copy(destFile, srcFile); err != nil {
+		os.Remove(inProgressPath)
+		return fmt.Errorf("failed to copy %q: %w", src, err)
+	}
+	// The copy must be on disk before it is renamed into place
+	if err := destFile.Sync(); err != nil {
+		os.Remove(inProgressPath)
+		return fmt.Errorf("failed to sync %q: %w", inProgressPath, err)
+	}
+	if err := destFile.Close(); err != nil {
+		os.Remove(inProgressPath)
+		return fmt.Errorf("failed to close %q: %w", inProgressPath, err)
+	}
+	if err := os.Rename(inProgressPath, dest); err != nil {
+		os.Remove(inProgressPath)
+		return fmt.Errorf("failed to rename %q into place: %w", dest, err)
+	}
+	return nil
+}
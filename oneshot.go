@@ -0,0 +1,77 @@
+package sqlitebackup
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Options configures Backup. The fields besides Config are the settings
+// of a Handler that are not part of its configuration.
+type Options struct {
+	Config Config
+	// Logger receives the logs of the backup, slog.Default() if nil.
+	Logger *slog.Logger
+	// Reason is why the backup runs, ReasonManual if empty, see
+	// JobPayload.Reason.
+	Reason string
+	// Labels are stored in the manifest, like the labels of a job.
+	Labels map[string]string
+	// Strategies are added as with Handler.RegisterStrategy.
+	Strategies map[string]Strategy
+	// KeyWrapper is set as with Handler.SetKeyWrapper.
+	KeyWrapper KeyWrapper
+	// AllowedSources restrict the source as with
+	// Handler.RestrictSourcePaths, nil for no restriction.
+	AllowedSources []string
+}
+
+// Result describes a backup run.
+type Result struct {
+	RunID    string
+	Duration time.Duration
+	// Manifest describes the written backup and Path is where it was
+	// written. Both are empty if the backup was skipped, e.g. within
+	// the maintenance window.
+	Manifest *Manifest
+	Path     string
+}
+
+// Skipped reports whether the run wrote no backup.
+func (r *Result) Skipped() bool {
+	return r.Manifest == nil
+}
+
+// Backup runs a single backup without a Handler or job, for applications
+// using the package as a library. The configuration is validated first.
+// It runs the same code as Handler.Handle.
+func Backup(ctx context.Context, opts Options) (*Result, error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	cfg := opts.Config
+	h := NewHandler(&cfg, logger)
+
+	for name, s := range opts.Strategies {
+		if err := h.RegisterStrategy(name, s); err != nil {
+			return nil, err
+		}
+	}
+	if opts.KeyWrapper != nil {
+		h.SetKeyWrapper(opts.KeyWrapper)
+	}
+	if opts.AllowedSources != nil {
+		if err := h.RestrictSourcePaths(opts.AllowedSources...); err != nil {
+			return nil, err
+		}
+	}
+	if err := h.Validate(); err != nil {
+		return nil, err
+	}
+	reason := opts.Reason
+	if reason == "" {
+		reason = ReasonManual
+	}
+	return h.run(ctx, reason, opts.Labels)
+}
@@ -0,0 +1,134 @@
+package sqlitebackup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"filippo.io/age"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// OpenOptions configures OpenBackup.
+type OpenOptions struct {
+	// Identities decrypt age encrypted backups.
+	Identities []age.Identity
+	// TempDir is where the backup is decompressed, os.TempDir() if empty.
+	// Point it at an encrypted volume or a tmpfs to keep the plaintext of
+	// encrypted backups off unencrypted disks.
+	TempDir string
+	// InMemory loads the backup into memory instead of decompressing it to
+	// disk. The binding copies the data into SQLite owned memory, so peak
+	// memory is about twice the uncompressed database size. Forensic
+	// archives are not supported, a WAL can only be replayed from files
+	// on disk.
+	InMemory bool
+	// ReadWrite opens the decompressed copy read-write, the way a
+	// restored database is opened, so SQLite rolls back a hot journal or
+	// recovers the WAL instead of reading around them. The backup file
+	// itself is never modified. Not supported with InMemory.
+	ReadWrite bool
+}
+
+// OpenBackup decompresses a backup, or restores a forensic archive, and
+// returns a read-only connection to it, or a read-write one to the copy
+// with OpenOptions.ReadWrite, for tooling that queries a backup
+// without a full restore. The caller must call cleanup when done, it
+// closes the connection and removes the temporary database.
+func OpenBackup(backupPath string, opts OpenOptions) (conn *sqlite.Conn, cleanup func(), err error) {
+	conn, _, cleanup, err = openBackup(backupPath, opts, 0)
+	return conn, cleanup, err
+}
+
+// openBackup is OpenBackup also returning the path of the decompressed
+// database, empty in memory. The decompressed size is checked against
+// expectedSize, see checkSize.
+func openBackup(backupPath string, opts OpenOptions, expectedSize int64) (conn *sqlite.Conn, dbPath string, cleanup func(), err error) {
+	if opts.InMemory {
+		if opts.ReadWrite {
+			return nil, "", nil, fmt.Errorf("read-write open is not supported in memory")
+		}
+		conn, cleanup, err = openInMemory(backupPath, opts.Identities, expectedSize)
+		return conn, "", cleanup, err
+	}
+
+	// The plaintext database lives in a fresh directory only the current
+	// user can enter, together with the -wal and -shm files opening a WAL
+	// database may create next to it
+	tempDir, err := os.MkdirTemp(opts.TempDir, "opened-*")
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	tempDBPath := filepath.Join(tempDir, "backup.db")
+	removeTemp := func() { os.RemoveAll(tempDir) }
+	if IsArchive(backupPath) {
+		err = restoreArchive(backupPath, tempDBPath, opts.Identities, expectedSize)
+	} else {
+		err = decompressFile(backupPath, tempDBPath, opts.Identities, expectedSize)
+	}
+	if err != nil {
+		removeTemp()
+		return nil, "", nil, fmt.Errorf("failed to decompress backup: %w", err)
+	}
+
+	flags := sqlite.OpenReadOnly
+	if opts.ReadWrite {
+		flags = sqlite.OpenReadWrite
+	}
+	conn, err = sqlite.OpenConn(tempDBPath, flags)
+	if err != nil {
+		removeTemp()
+		return nil, "", nil, fmt.Errorf("failed to open decompressed database: %w", err)
+	}
+
+	return conn, tempDBPath, func() {
+		conn.Close()
+		removeTemp()
+	}, nil
+}
+
+// openInMemory loads a backup into an in-memory database with
+// sqlite3_deserialize, without touching disk.
+func openInMemory(backupPath string, identities []age.Identity, expectedSize int64) (*sqlite.Conn, func(), error) {
+	if IsArchive(backupPath) {
+		return nil, nil, fmt.Errorf("in-memory open does not support forensic archives")
+	}
+
+	reader, err := openDecompressed(backupPath, identities)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decompress backup: %w", err)
+	}
+	if err := checkSize(expectedSize, int64(len(data))); err != nil {
+		return nil, nil, err
+	}
+
+	// The in-memory VFS cannot open a database flagged for WAL. The flag
+	// only lives in the header, the pages are the same in both modes.
+	const headerSize = 100
+	if len(data) >= headerSize && data[18] == 2 && data[19] == 2 {
+		data[18], data[19] = 1, 1
+	}
+
+	conn, err := sqlite.OpenConn(":memory:", sqlite.OpenReadWrite|sqlite.OpenCreate|sqlite.OpenMemory)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open in-memory database: %w", err)
+	}
+	if err := conn.Deserialize("main", data); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to load backup into memory: %w", err)
+	}
+	// Callers get the same read-only view as with a decompressed file
+	if err := sqlitex.ExecuteTransient(conn, "PRAGMA query_only = ON;", nil); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to make in-memory database read-only: %w", err)
+	}
+
+	return conn, func() { conn.Close() }, nil
+}
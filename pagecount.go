@@ -0,0 +1,96 @@
+package sqlitebackup
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+const (
+	PageCountDropWarn          = "warn"
+	PageCountDropSkipRetention = "skip_retention"
+)
+
+// sourcePageCount returns the page count of the source database.
+func sourcePageCount(sourcePath string) (int64, error) {
+	conn, err := sqlite.OpenConn(sourcePath, sqlite.OpenReadOnly)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open source db for page count: %w", err)
+	}
+	defer conn.Close()
+
+	stmt, err := conn.Prepare("PRAGMA page_count;")
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare page_count statement: %w", err)
+	}
+	count, err := sqlitex.ResultInt64(stmt)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read page count: %w", err)
+	}
+	return count, nil
+}
+
+// previousPageCount returns the page count recorded in the manifest of the
+// newest earlier backup of database, 0 if there is none. Backups without
+// a readable manifest, e.g. with an encrypted one, are passed over.
+func (h *Handler) previousPageCount(database string) (int64, error) {
+	files, err := ListBackups(h.cfg.BackupDir)
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Time.After(files[j].Time)
+	})
+
+	for _, f := range files {
+		if f.Database != database {
+			continue
+		}
+		manifest, err := ReadManifest(filepath.Join(h.cfg.BackupDir, f.Name))
+		if err != nil || manifest.PageCount == 0 {
+			continue
+		}
+		return manifest.PageCount, nil
+	}
+	return 0, nil
+}
+
+// checkPageCountDrop compares the page count of the source with the one
+// of the previous backup. A drop by more than Config.MaxPageCountDrop
+// often means data was lost upstream. It is logged as a warning, and with
+// PageCountDropSkipRetention the returned flag makes the run keep every
+// older backup.
+func (h *Handler) checkPageCountDrop(database string, pageCount int64) (skipRetention bool, err error) {
+	action := h.cfg.PageCountDropAction
+	switch action {
+	case "", PageCountDropWarn, PageCountDropSkipRetention:
+	default:
+		return false, fmt.Errorf("unknown page count drop action: %q", action)
+	}
+
+	previous, err := h.previousPageCount(database)
+	if err != nil {
+		return false, err
+	}
+	if previous == 0 {
+		return false, nil
+	}
+
+	drop := 1 - float64(pageCount)/float64(previous)
+	if drop <= h.cfg.MaxPageCountDrop {
+		return false, nil
+	}
+
+	skipRetention = action == PageCountDropSkipRetention
+	h.logger.Warn("Source database shrank since the previous backup, data may have been lost upstream",
+		"page_count", pageCount,
+		"previous_page_count", previous,
+		"drop", drop,
+		"max_drop", h.cfg.MaxPageCountDrop,
+		"skip_retention", skipRetention,
+	)
+	return skipRetention, nil
+}
@@ -0,0 +1,144 @@
+package sqlitebackup
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// sqliteHeaderMagic starts every SQLite database file.
+const sqliteHeaderMagic = "SQLite format 3\x00"
+
+// pageSampleCheck is the spot check selected with
+// VerifyOptions.PageSampleRate instead of IntegrityCheck. It checks the
+// header of the database file at path, walks the freelist and reads a
+// random sample of rate of the pages, then reads the schema through conn.
+// It finds truncated files, a broken freelist and unreadable pages, but
+// not corrupt b-trees or indexes in the pages it does not look at, which
+// only PRAGMA integrity_check does.
+type pageSampleCheck struct {
+	path string
+	rate float64
+}
+
+// Verify implements the Verifier interface.
+func (c pageSampleCheck) Verify(ctx context.Context, conn *sqlite.Conn) error {
+	// The main file of a database with a non-empty WAL is not the whole
+	// database
+	if info, err := os.Stat(c.path + "-wal"); err == nil && info.Size() > 0 {
+		return fmt.Errorf("page sampling does not support databases with a WAL, use the integrity check")
+	}
+
+	f, err := os.Open(c.path)
+	if err != nil {
+		return fmt.Errorf("failed to open database for page sampling: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat database for page sampling: %w", err)
+	}
+
+	header := make([]byte, 100)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("failed to read database header: %w", err)
+	}
+	if string(header[:len(sqliteHeaderMagic)]) != sqliteHeaderMagic {
+		return fmt.Errorf("database header has no SQLite magic string")
+	}
+	pageSize := int64(binary.BigEndian.Uint16(header[16:18]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	if pageSize < 512 || pageSize&(pageSize-1) != 0 {
+		return fmt.Errorf("database header has an invalid page size %d", pageSize)
+	}
+	if info.Size()%pageSize != 0 {
+		return fmt.Errorf("database size %d is not a multiple of the page size %d", info.Size(), pageSize)
+	}
+	pageCount := info.Size() / pageSize
+	// The in-header size is only valid if written by the same version
+	// that last changed the file
+	if n := int64(binary.BigEndian.Uint32(header[28:32])); n != 0 && binary.BigEndian.Uint32(header[92:96]) == binary.BigEndian.Uint32(header[24:28]) && n != pageCount {
+		return fmt.Errorf("database header records %d pages, the file holds %d", n, pageCount)
+	}
+	usableSize := pageSize - int64(header[20])
+
+	if err := checkFreelist(f, header, pageSize, usableSize, pageCount); err != nil {
+		return err
+	}
+
+	// The last page is always read, it catches a truncated file
+	samples := int64(math.Ceil(c.rate * float64(pageCount)))
+	page := make([]byte, pageSize)
+	for i := int64(0); i <= samples; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		pgno := pageCount
+		if i > 0 {
+			pgno = rand.Int63n(pageCount) + 1
+		}
+		if _, err := f.ReadAt(page, (pgno-1)*pageSize); err != nil {
+			return fmt.Errorf("failed to read page %d: %w", pgno, err)
+		}
+	}
+
+	stmt, err := conn.Prepare("SELECT count(*) FROM sqlite_schema;")
+	if err != nil {
+		return fmt.Errorf("failed to read schema: %w", err)
+	}
+	if _, err := sqlitex.ResultInt64(stmt); err != nil {
+		return fmt.Errorf("failed to read schema: %w", err)
+	}
+	return nil
+}
+
+// checkFreelist walks the freelist trunk pages of the database in r and
+// checks that every page number is in range, no trunk page is visited
+// twice and the number of pages matches the header.
+func checkFreelist(r io.ReaderAt, header []byte, pageSize, usableSize, pageCount int64) error {
+	trunk := int64(binary.BigEndian.Uint32(header[32:36]))
+	total := int64(binary.BigEndian.Uint32(header[36:40]))
+	maxLeaves := usableSize/4 - 2
+
+	page := make([]byte, pageSize)
+	visited := make(map[int64]bool)
+	var found int64
+	for trunk != 0 {
+		if trunk < 2 || trunk > pageCount || visited[trunk] {
+			return fmt.Errorf("freelist has an invalid trunk page %d", trunk)
+		}
+		visited[trunk] = true
+		if _, err := r.ReadAt(page, (trunk-1)*pageSize); err != nil {
+			return fmt.Errorf("failed to read freelist trunk page %d: %w", trunk, err)
+		}
+
+		leaves := int64(binary.BigEndian.Uint32(page[4:8]))
+		if leaves > maxLeaves {
+			return fmt.Errorf("freelist trunk page %d lists %d leaves, at most %d fit", trunk, leaves, maxLeaves)
+		}
+		for i := int64(0); i < leaves; i++ {
+			leaf := int64(binary.BigEndian.Uint32(page[8+4*i : 12+4*i]))
+			if leaf < 2 || leaf > pageCount {
+				return fmt.Errorf("freelist trunk page %d lists an invalid leaf page %d", trunk, leaf)
+			}
+		}
+		found += 1 + leaves
+		if found > total {
+			break
+		}
+		trunk = int64(binary.BigEndian.Uint32(page[0:4]))
+	}
+	if found != total {
+		return fmt.Errorf("freelist holds %d pages, the header records %d", found, total)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package sqlitebackup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// resolvePath returns the absolute path with all symlinks evaluated. The
+// last element may not exist yet, in that case only its parent directory
+// is resolved.
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err == nil {
+		return resolved, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	dir, err := filepath.EvalSymlinks(filepath.Dir(abs))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(abs)), nil
+}
+
+// ensureDistinct fails if dest resolves to the same file as the resolved
+// source path.
+func ensureDistinct(resolvedSource, dest string) error {
+	resolvedDest, err := resolvePath(dest)
+	if err != nil {
+		return fmt.Errorf("failed to resolve path %q: %w", dest, err)
+	}
+	if resolvedDest == resolvedSource {
+		return fmt.Errorf("refusing to write backup to %q: it resolves to the source database %q", dest, resolvedSource)
+	}
+	return nil
+}
+
+// RestrictSourcePaths limits the databases the handler backs up to the
+// given files and to files below the given directories. The source path
+// is checked after symlinks are resolved, so a config from a shared store
+// cannot point the handler at arbitrary files. Call it before the handler
+// is registered; the allowlist is set by the application, not by Config,
+// which is the input it guards against.
+func (h *Handler) RestrictSourcePaths(paths ...string) error {
+	allowed := make([]string, 0, len(paths))
+	for _, path := range paths {
+		resolved, err := resolvePath(path)
+		if err != nil {
+			return fmt.Errorf("failed to resolve allowed source path %q: %w", path, err)
+		}
+		allowed = append(allowed, resolved)
+	}
+	h.allowedSources = allowed
+	return nil
+}
+
+// checkSourceAllowed fails if RestrictSourcePaths was called and the
+// resolved source path is not within any of the allowed paths.
+func (h *Handler) checkSourceAllowed(resolvedSource string) error {
+	if h.allowedSources == nil {
+		return nil
+	}
+	for _, allowed := range h.allowedSources {
+		rel, err := filepath.Rel(allowed, resolvedSource)
+		if err != nil {
+			continue
+		}
+		if rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))) {
+			return nil
+		}
+	}
+	return fmt.Errorf("refusing to back up %q: it is not within the allowed source paths", resolvedSource)
+}
+
+const (
+	ExistingBackupError     = "error"
+	ExistingBackupOverwrite = "overwrite"
+	ExistingBackupSkip      = "skip"
+)
+
+// checkExistingBackup applies the ExistingBackupPolicy to the final path
+// of a backup, which may already exist after clock skew or a re-run. It
+// reports whether the backup should be skipped.
+func (h *Handler) checkExistingBackup(finalBackupPath string) (bool, error) {
+	policy := h.cfg.ExistingBackupPolicy
+	switch policy {
+	case "", ExistingBackupError, ExistingBackupSkip, ExistingBackupOverwrite:
+	default:
+		return false, fmt.Errorf("unknown existing backup policy: %q", policy)
+	}
+
+	if _, err := os.Lstat(finalBackupPath); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to check for existing backup %q: %w", finalBackupPath, err)
+	}
+
+	switch policy {
+	case ExistingBackupOverwrite:
+		h.logger.Warn("Backup file already exists and will be overwritten", "path", finalBackupPath)
+		return false, nil
+	case ExistingBackupSkip:
+		h.logger.Info("Backup file already exists, skipping backup", "path", finalBackupPath)
+		return true, nil
+	default:
+		return false, fmt.Errorf("refusing to overwrite existing backup %q", finalBackupPath)
+	}
+}
+
+// errNewerBackup is returned by compressAndFinalize when
+// checkNewerBackup skips the backup.
+var errNewerBackup = errors.New("newer backup exists")
+
+// errBackupExists is returned by compressAndFinalize when the final path
+// appeared during the compression and checkExistingBackup skips the
+// backup.
+var errBackupExists = errors.New("backup exists")
+
+// checkNewerBackup reports whether backup_dir holds a backup of the same
+// database as finalBackupPath started no earlier than this run, which
+// started at startedAt, e.g. by another instance sharing the directory.
+// Filename timestamps have second precision, so a backup started in the
+// same second counts as newer. finalBackupPath itself is not considered.
+func (h *Handler) checkNewerBackup(finalBackupPath string, startedAt time.Time) (bool, error) {
+	own, err := ParseBackupFilename(filepath.Base(finalBackupPath))
+	if err != nil {
+		return false, err
+	}
+	files, err := ListBackups(h.cfg.BackupDir)
+	if err != nil {
+		return false, err
+	}
+	since := startedAt.Truncate(time.Second)
+	for _, f := range files {
+		if f.Database != own.Database || f.Name == own.Name || f.Time.Before(since) {
+			continue
+		}
+		h.logger.Warn("A newer backup was written since this run started, skipping backup",
+			"newer_backup", f.Name,
+			"started_at", startedAt,
+		)
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,123 @@
+package sqlitebackup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caasmo/restinpieces/db"
+)
+
+func TestBackupNamesSymlinkedSourceAfterTarget(t *testing.T) {
+	tests := []struct {
+		name string
+		// link creates the configured source path pointing at target
+		link func(t *testing.T, dir, target string) string
+	}{
+		{
+			name: "file symlink",
+			link: func(t *testing.T, dir, target string) string {
+				return symlink(t, target, filepath.Join(dir, "current.db"))
+			},
+		},
+		{
+			name: "symlink chain",
+			link: func(t *testing.T, dir, target string) string {
+				first := symlink(t, target, filepath.Join(dir, "previous.db"))
+				return symlink(t, first, filepath.Join(dir, "current.db"))
+			},
+		},
+		{
+			name: "relative symlink",
+			link: func(t *testing.T, dir, target string) string {
+				return symlink(t, filepath.Join("data", filepath.Base(target)), filepath.Join(dir, "current.db"))
+			},
+		},
+		{
+			name: "symlinked directory",
+			link: func(t *testing.T, dir, target string) string {
+				linkDir := symlink(t, filepath.Dir(target), filepath.Join(dir, "live"))
+				return filepath.Join(linkDir, filepath.Base(target))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			target := filepath.Join(dir, "data", "app.db")
+			backupDir := filepath.Join(dir, "backups")
+			for _, d := range []string{filepath.Dir(target), backupDir} {
+				if err := os.Mkdir(d, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			createTestDatabase(t, target)
+
+			cfg := Config{
+				SourcePath: tt.link(t, dir, target),
+				BackupDir:  backupDir,
+				Strategy:   StrategyVacuum,
+			}
+			h := NewHandler(&cfg, discardLogger())
+			if err := h.Handle(context.Background(), db.Job{}); err != nil {
+				t.Fatal(err)
+			}
+
+			backups, err := filepath.Glob(filepath.Join(backupDir, "*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			named, err := filepath.Glob(filepath.Join(backupDir, "app-*-vacuum.bck*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(backups) != 1 || len(named) != 1 {
+				t.Errorf("got backups %q, want one named after the target app.db", backups)
+			}
+		})
+	}
+}
+
+func TestEnsureDistinct(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "data", "app.db")
+	if err := os.Mkdir(filepath.Dir(source), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(source, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	linkDir := symlink(t, filepath.Dir(source), filepath.Join(dir, "live"))
+	linkFile := symlink(t, source, filepath.Join(dir, "current.db"))
+
+	tests := []struct {
+		name    string
+		dest    string
+		wantErr bool
+	}{
+		{"source itself", source, true},
+		{"through symlinked directory", filepath.Join(linkDir, "app.db"), true},
+		{"symlink to source", linkFile, true},
+		{"unresolved dot segments", filepath.Join(dir, "data", "..", "data", "app.db"), true},
+		{"other file", filepath.Join(dir, "data", "app.db.bck"), false},
+		{"missing file in symlinked directory", filepath.Join(linkDir, "new.bck"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ensureDistinct(source, tt.dest)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ensureDistinct(%q) error = %v, want error %v", tt.dest, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// symlink creates link pointing at target and returns link.
+func symlink(t *testing.T, target, link string) string {
+	t.Helper()
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+	return link
+}
@@ -0,0 +1,149 @@
+package sqlitebackup
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"runtime"
+	"strconv"
+)
+
+// applyPermissions sets the configured mode, and changes the owner of path
+// to the configured uid and gid. Every file and directory the handler
+// creates goes through it, so the configured permissions hold whatever
+// the umask of the process is.
+func (h *Handler) applyPermissions(path string) error {
+	if err := h.applyMode(path); err != nil {
+		return err
+	}
+	return h.applyOwnership(path)
+}
+
+// applyMode sets Config.FileMode or Config.DirMode on path. Without them
+// the mode is left as created: 0600 for files written with createFile,
+// subject to the umask for directories.
+func (h *Handler) applyMode(path string) error {
+	if h.cfg.FileMode == "" && h.cfg.DirMode == "" {
+		return nil
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat %q: %w", path, err)
+	}
+	modeSetting, key := h.cfg.FileMode, "file_mode"
+	if info.IsDir() {
+		modeSetting, key = h.cfg.DirMode, "dir_mode"
+	}
+	if modeSetting == "" {
+		return nil
+	}
+
+	mode, err := parseMode(modeSetting)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", key, err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return fmt.Errorf("failed to change mode of %q to %v: %w", path, mode, err)
+	}
+	return nil
+}
+
+// createFile creates, or truncates, the file at path for writing with the
+// mode and owner of restrictFile, set before any data is written. Backups
+// and plaintext sidecars are never readable by others while they are
+// written, whatever the umask of the process is.
+func (h *Handler) createFile(path string) (*os.File, error) {
+	mode, err := h.fileMode()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.restrictFile(path); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// writeFile writes data to the file at path, created with createFile.
+func (h *Handler) writeFile(path string, data []byte) error {
+	file, err := h.createFile(path)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// restrictFile sets Config.FileMode, or 0600 without it, and the
+// configured owner on the file at path. The mode is set explicitly, the
+// umask may have cleared bits of it and an existing file keeps its mode.
+func (h *Handler) restrictFile(path string) error {
+	mode, err := h.fileMode()
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return fmt.Errorf("failed to change mode of %q to %v: %w", path, mode, err)
+	}
+	return h.applyOwnership(path)
+}
+
+// fileMode returns the mode of the files the handler writes,
+// Config.FileMode or 0600.
+func (h *Handler) fileMode() (fs.FileMode, error) {
+	if h.cfg.FileMode == "" {
+		return 0600, nil
+	}
+	mode, err := parseMode(h.cfg.FileMode)
+	if err != nil {
+		return 0, fmt.Errorf("invalid file_mode: %w", err)
+	}
+	return mode, nil
+}
+
+// parseMode parses an octal permission mode, e.g. "0640".
+func parseMode(s string) (fs.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("%q is not an octal permission mode like 0640", s)
+	}
+	return fs.FileMode(mode), nil
+}
+
+// applyOwnership changes the owner of path to the configured uid and gid.
+// It is a no-op if neither is configured. A missing id is left unchanged.
+func (h *Handler) applyOwnership(path string) error {
+	if h.cfg.UID == nil && h.cfg.GID == nil {
+		return nil
+	}
+
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		h.logger.Warn("Changing file ownership is not supported on this platform, ignoring uid/gid", "os", runtime.GOOS, "path", path)
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if h.cfg.UID != nil {
+		uid = *h.cfg.UID
+	}
+	if h.cfg.GID != nil {
+		gid = *h.cfg.GID
+	}
+
+	if err := os.Chown(path, uid, gid); err != nil {
+		if errors.Is(err, fs.ErrPermission) {
+			return fmt.Errorf("not permitted to change owner of %q to %d:%d, the process needs CAP_CHOWN or to run as root: %w", path, uid, gid, err)
+		}
+		return fmt.Errorf("failed to change owner of %q to %d:%d: %w", path, uid, gid, err)
+	}
+	return nil
+}
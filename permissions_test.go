@@ -0,0 +1,90 @@
+package sqlitebackup
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCreateFileSetsModeBeforeWriting(t *testing.T) {
+	tests := []struct {
+		fileMode string
+		want     fs.FileMode
+	}{
+		{"", 0600},
+		{"0640", 0640},
+	}
+	for _, tt := range tests {
+		t.Run("mode "+tt.fileMode, func(t *testing.T) {
+			h := NewHandler(&Config{FileMode: tt.fileMode}, discardLogger())
+			path := filepath.Join(t.TempDir(), "backup.bck.gz")
+			// OpenFile keeps the mode of an existing file, createFile must still restrict it
+
+			if err := os.WriteFile(path, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err := h.createFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			info, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != tt.want {
+				t.Errorf("created with mode %v, want %v", info.Mode().Perm(), tt.want)
+			}
+		})
+	}
+}
+
+func TestBackupFileModes(t *testing.T) {
+	tests := []struct {
+		fileMode string
+		want     fs.FileMode
+	}{
+		{"", 0600},
+		{"0640", 0640},
+	}
+	for _, tt := range tests {
+		t.Run("mode "+tt.fileMode, func(t *testing.T) {
+			dir := t.TempDir()
+			sourcePath := filepath.Join(dir, "app.db")
+			createTestDatabase(t, sourcePath)
+			cfg := Config{
+				SourcePath: sourcePath,
+				BackupDir:  filepath.Join(dir, "backups"),
+				Strategy:   StrategyVacuum,
+				MirrorDirs: []string{filepath.Join(dir, "mirror")},
+				Manifest:   true,
+				HTTPMeta:   true,
+				MarkerPath: filepath.Join(dir, "marker.json"),
+				FileMode:   tt.fileMode,
+			}
+			result, err := Backup(context.Background(), Options{Config: cfg, Logger: discardLogger()})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			manifestPath := strings.TrimSuffix(result.Path, EncryptionExtension) + ManifestExtension
+			paths := []string{result.Path, manifestPath, result.Path + MetaExtension, cfg.MarkerPath}
+			for _, p := range paths[:3] {
+				paths = append(paths, filepath.Join(cfg.MirrorDirs[0], filepath.Base(p)))
+			}
+			for _, p := range paths {
+				info, err := os.Stat(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Mode().Perm() != tt.want {
+					t.Errorf("%s has mode %v, want %v", filepath.Base(p), info.Mode().Perm(), tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package sqlitebackup
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+const (
+	// lowPriorityNice is the CPU nice value of the backup thread.
+	lowPriorityNice = 19
+
+	// ioprio_set(2) arguments for the lowest best-effort I/O priority.
+	// The idle class is avoided, on a busy disk it may never be served.
+	ioprioWhoProcess  = 1
+	ioprioClassShift  = 13
+	ioprioClassBE     = 2
+	ioprioLowestLevel = 7
+)
+
+// runLowPriority runs fn on a dedicated OS thread with lowered CPU and I/O
+// priority. On Linux both are per-thread attributes, so the application
+// sharing the process keeps its priority. The thread stays locked until
+// the goroutine exits, which makes the runtime terminate it instead of
+// returning the lowered thread to the pool.
+func (h *Handler) runLowPriority(fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		tid := syscall.Gettid()
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, lowPriorityNice); err != nil {
+			h.logger.Warn("Failed to lower CPU priority of the backup", "error", err)
+		}
+		ioprio := ioprioClassBE<<ioprioClassShift | ioprioLowestLevel
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(ioprio)); errno != 0 {
+			h.logger.Warn("Failed to lower I/O priority of the backup", "error", fmt.Errorf("ioprio_set: %w", errno))
+		}
+
+		done <- fn()
+	}()
+	return <-done
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package sqlitebackup
+
+import "runtime"
+
+// runLowPriority runs fn unchanged, lowering the priority of a single
+// thread is only supported on Linux.
+func (h *Handler) runLowPriority(fn func() error) error {
+	h.logger.Warn("Low priority backups are not supported on this platform, running at normal priority", "os", runtime.GOOS)
+	return fn()
+}
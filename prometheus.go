@@ -0,0 +1,82 @@
+package sqlitebackup
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// lastSuccessMetric is read back from the previous textfile, see
+// previousLastSuccess.
+const lastSuccessMetric = "sqlite_backup_last_success_timestamp_seconds"
+
+// writePrometheusTextfile writes the stats to Config.PrometheusTextfile in
+// the text exposition format, for the textfile collector of
+// node_exporter. The file is written next to its final path and renamed
+// into place, so the collector never reads a partial file. A failure is
+// logged and does not fail the job.
+func (h *Handler) writePrometheusTextfile(failed bool) {
+	path := h.cfg.PrometheusTextfile
+	stats := h.Stats()
+
+	// A process started per run, e.g. by cron, has no earlier success in
+	// its stats, the previous file keeps it
+	lastSuccess := previousLastSuccess(path)
+	if !stats.LastSuccessAt.IsZero() {
+		lastSuccess = float64(stats.LastSuccessAt.Unix())
+	}
+	success := 1
+	if failed {
+		success = 0
+	}
+
+	labels := fmt.Sprintf(`{database=%q}`, strings.TrimSuffix(filepath.Base(h.cfg.SourcePath), filepath.Ext(h.cfg.SourcePath)))
+	var buf bytes.Buffer
+	metric := func(name, typ, help string, value float64) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n%s%s %s\n", name, help, name, typ, name, labels, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	metric("sqlite_backup_last_run_timestamp_seconds", "gauge", "Start time of the last backup run.", float64(stats.LastRunAt.Unix()))
+	metric(lastSuccessMetric, "gauge", "Time the last successful backup run finished, 0 if none.", lastSuccess)
+	metric("sqlite_backup_last_run_success", "gauge", "Whether the last backup run succeeded.", float64(success))
+	metric("sqlite_backup_last_duration_seconds", "gauge", "Duration of the last backup run.", stats.LastDuration.Seconds())
+	metric("sqlite_backup_last_size_bytes", "gauge", "Size of the last backup file.", float64(stats.LastBackupSize))
+	metric("sqlite_backup_runs_total", "counter", "Backup runs since the handler was created.", float64(stats.TotalRuns))
+	metric("sqlite_backup_failures_total", "counter", "Failed backup runs since the handler was created.", float64(stats.Failures))
+
+	inProgressPath := path + h.inProgressSuffix()
+	if err := os.WriteFile(inProgressPath, buf.Bytes(), 0644); err != nil {
+		os.Remove(inProgressPath)
+		h.logger.Error("Failed to write Prometheus textfile", "path", path, "error", err)
+		return
+	}
+	if err := os.Rename(inProgressPath, path); err != nil {
+		os.Remove(inProgressPath)
+		h.logger.Error("Failed to rename Prometheus textfile into place", "path", path, "error", err)
+	}
+}
+
+// previousLastSuccess returns the last success timestamp of the textfile
+// at path, 0 if it has none.
+func previousLastSuccess(path string) float64 {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.LastIndex(line, " ")
+		if i < 0 || !strings.HasPrefix(line, lastSuccessMetric+"{") {
+			continue
+		}
+		value := line[i+1:]
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			return v
+		}
+	}
+	return 0
+}
@@ -0,0 +1,149 @@
+package sqlitebackup
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PruneOptions configures PruneBackupsWithOptions.
+type PruneOptions struct {
+	// KeepLast maps a strategy to the number of its newest backups kept
+	// per database, see PruneBackups.
+	KeepLast map[string]int
+	// GracePeriod delays the removal of a backup that fell out of
+	// KeepLast: it is only removed once the newer backup that pushed it
+	// out was written at least GracePeriod ago, so a reader that picked
+	// it while it was still kept, e.g. a client downloading the latest
+	// backup, has GracePeriod to finish.
+	GracePeriod time.Duration
+}
+
+// PruneBackups removes old backups from dir, keeping the newest
+// keepLast[strategy] backups of every database and strategy. Strategies
+// without an entry, or with a count of 0 or less, are left untouched, as
+// are files not named by the Handler. The manifest of a removed backup is
+// removed with it. It returns the paths of the removed backups.
+func PruneBackups(dir string, keepLast map[string]int) ([]string, error) {
+	return PruneBackupsWithOptions(dir, PruneOptions{KeepLast: keepLast})
+}
+
+// PruneBackupsWithOptions is PruneBackups with a grace period.
+func PruneBackupsWithOptions(dir string, opts PruneOptions) ([]string, error) {
+	keepLast := opts.KeepLast
+	files, err := ListBackups(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type group struct{ database, strategy string }
+	groups := make(map[group][]BackupFile)
+	for _, f := range files {
+		if keepLast[f.Strategy] <= 0 {
+			continue
+		}
+		g := group{f.Database, f.Strategy}
+		groups[g] = append(groups[g], f)
+	}
+
+	var removed []string
+	for g, backups := range groups {
+		keep := keepLast[g.strategy]
+		if len(backups) <= keep {
+			continue
+		}
+		sort.Slice(backups, func(i, j int) bool {
+			return backups[i].Time.After(backups[j].Time)
+		})
+		// Once a backup is past the grace period, so are the older ones,
+		// their displacing backups are not checked, they may be removed
+		expired := opts.GracePeriod <= 0
+		for i, f := range backups[keep:] {
+			if !expired {
+				// backups[i] is the newer backup that pushed f out of the
+				// kept ones
+				within, err := withinGracePeriod(filepath.Join(dir, backups[i].Name), opts.GracePeriod)
+				if err != nil {
+					return removed, err
+				}
+				if within {
+					continue
+				}
+				expired = true
+			}
+			path := filepath.Join(dir, f.Name)
+			if err := removeBackup(path); err != nil {
+				return removed, err
+			}
+			removed = append(removed, path)
+		}
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
+
+// withinGracePeriod reports whether the backup at path was written less
+// than grace ago. The modification time is used rather than the filename
+// timestamp, which is when the backup started: the backup only became
+// visible once renamed into place at the end.
+func withinGracePeriod(path string, grace time.Duration) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat backup for grace period: %w", err)
+	}
+	return time.Since(info.ModTime()) < grace, nil
+}
+
+// removeBackup removes a backup file, its metadata and signature
+// sidecars, its bundle and its manifest, plain or encrypted.
+func removeBackup(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove backup: %w", err)
+	}
+	for _, ext := range []string{MetaExtension, SignatureExtension} {
+		if err := os.Remove(path + ext); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove backup sidecar: %w", err)
+		}
+	}
+	// The bundle is named after the backup of its source
+	if bundleName, err := BundleName(filepath.Base(path)); err == nil {
+		if err := os.Remove(filepath.Join(filepath.Dir(path), bundleName)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove backup bundle: %w", err)
+		}
+	}
+	manifestPath := strings.TrimSuffix(path, EncryptionExtension) + ManifestExtension
+	for _, p := range []string{manifestPath, manifestPath + EncryptionExtension} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove backup manifest: %w", err)
+		}
+	}
+	return nil
+}
+
+// pruneBackups applies Config.KeepLast to the backup directory and to
+// every mirror directory, each on its own. Failures are logged per
+// directory, the backup that was just written is not affected by them.
+func (h *Handler) pruneBackups() {
+	if len(h.cfg.KeepLast) == 0 {
+		return
+	}
+
+	opts := PruneOptions{
+		KeepLast:    h.cfg.KeepLast,
+		GracePeriod: h.cfg.RetentionGracePeriod.Duration,
+	}
+	for _, dir := range append([]string{h.cfg.BackupDir}, h.cfg.MirrorDirs...) {
+		removed, err := PruneBackupsWithOptions(dir, opts)
+		for _, path := range removed {
+			h.logger.Info("Removed old backup", "path", path)
+		}
+		if err != nil {
+			h.logger.Warn("Failed to prune old backups", "dir", dir, "removed", len(removed), "error", err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package sqlitebackup
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestPruneBackupsPrunesMirrors(t *testing.T) {
+	dir := t.TempDir()
+	backupDir := filepath.Join(dir, "backups")
+	mirrorDir := filepath.Join(dir, "mirror")
+	names := []string{
+		"app-2025-07-01T10-00-00Z-online.bck.gz",
+		"app-2025-07-02T10-00-00Z-online.bck.gz",
+		"app-2025-07-03T10-00-00Z-online.bck.gz",
+	}
+	for _, d := range []string{backupDir, mirrorDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			if err := os.WriteFile(filepath.Join(d, name), nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	cfg := &Config{
+		BackupDir:  backupDir,
+		MirrorDirs: []string{mirrorDir, filepath.Join(dir, "missing")},
+		KeepLast:   map[string]int{StrategyOnline: 1},
+	}
+	NewHandler(cfg, slog.New(slog.NewTextHandler(io.Discard, nil))).pruneBackups()
+
+	for _, d := range []string{backupDir, mirrorDir} {
+		files, err := ListBackups(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 || files[0].Name != names[2] {
+			t.Errorf("%s holds %v, want only %s", d, files, names[2])
+		}
+	}
+}
+
+func TestPruneBackupsOrdersMixedFilenameSchemes(t *testing.T) {
+	dir := t.TempDir()
+	// Newest first by time, the names sort in a different order
+	kept := []string{
+		"app-r8248461399-online.bck.gz",              // 2025-07-03T10:30:00Z
+		"app-2025-07-02T12-30-00+0200-online.bck.gz", // 2025-07-02T10:30:00Z
+	}
+	removed := []string{
+		"app-2025-07-01T10-30-00Z-online.bck.gz",
+		"app-r8248720599-online.bck.gz", // 2025-06-30T10:30:00Z
+	}
+	for _, name := range append(kept, removed...) {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := PruneBackups(dir, map[string]int{StrategyOnline: len(kept)}); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ListBackups(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range files {
+		got = append(got, f.Name)
+	}
+	slices.Sort(got)
+	want := slices.Sorted(slices.Values(kept))
+	if !slices.Equal(got, want) {
+		t.Errorf("kept %q, want %q", got, want)
+	}
+	if latest, ok := LatestBackup(files, "app"); !ok || latest.Name != kept[0] {
+		t.Errorf("got latest %q, want %q", latest.Name, kept[0])
+	}
+}
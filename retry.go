@@ -0,0 +1,61 @@
+package sqlitebackup
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// DefaultBackupDirBackoff is the wait before the first retry of a
+// directory operation on BackupDir, see Config.BackupDirRetries.
+const DefaultBackupDirBackoff = time.Second
+
+// retryDirOp runs fn, an operation named op on path in BackupDir, and
+// retries it up to Config.BackupDirRetries times with exponential backoff
+// while it fails with a transient mount error. knownDir, if not empty, is
+// a directory known to exist, see isTransientMountError.
+func (h *Handler) retryDirOp(ctx context.Context, op, path, knownDir string, fn func() error) error {
+	backoff := h.cfg.BackupDirBackoff.Duration
+	if backoff <= 0 {
+		backoff = DefaultBackupDirBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if attempt >= h.cfg.BackupDirRetries || !isTransientMountError(err, knownDir) {
+			return err
+		}
+
+		h.logger.Warn("Backup directory unavailable, retrying", "op", op, "path", path, "attempt", attempt+1, "retries", h.cfg.BackupDirRetries, "backoff", backoff, "error", err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// isTransientMountError reports whether err is the failure of a network
+// mount that may come back, e.g. a stale NFS handle or a disconnected
+// FUSE mount, as opposed to a permission or full disk error. A missing
+// file only counts if knownDir, a directory that existed earlier in the
+// run, is gone as well, as when an automount expired.
+func isTransientMountError(err error, knownDir string) bool {
+	for _, errno := range []syscall.Errno{syscall.ESTALE, syscall.ENOTCONN, syscall.EHOSTDOWN, syscall.ETIMEDOUT} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	if knownDir != "" && errors.Is(err, os.ErrNotExist) {
+		_, statErr := os.Stat(knownDir)
+		return statErr != nil
+	}
+	return false
+}
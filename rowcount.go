@@ -0,0 +1,77 @@
+package sqlitebackup
+
+import (
+	"context"
+	"fmt"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// rowCountTableLimit is the largest number of tables of a backup whose
+// row counts are logged one by one.
+const rowCountTableLimit = 10
+
+// logRowCounts logs the number of tables and rows of the uncompressed
+// backup at path, with the count of every table for small databases.
+// Virtual tables are not counted. Counting reads every table, see
+// Config.LogRowCounts. A failure is logged and does not fail the job.
+func (h *Handler) logRowCounts(ctx context.Context, path string) {
+	if h.cfg.Strategy == StrategyForensic {
+		h.logger.Warn("Row counts of forensic archives are not supported, skipping", "path", path)
+		return
+	}
+	counts, total, err := countRows(ctx, path)
+	if err != nil {
+		h.logger.Error("Failed to count rows of backup", "error", err)
+		return
+	}
+
+	args := []any{"tables", len(counts), "rows", total}
+	if len(counts) <= rowCountTableLimit {
+		args = append(args, "table_rows", counts)
+	}
+	h.logger.Info("Backup row count summary", args...)
+}
+
+// countRows returns the row count of every table of the database at path
+// and their sum.
+func countRows(ctx context.Context, path string) (map[string]int64, int64, error) {
+	conn, err := sqlite.OpenConn(path, sqlite.OpenReadOnly)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open backup for row counts: %w", err)
+	}
+	defer conn.Close()
+	conn.SetInterrupt(ctx.Done())
+
+	var tables []string
+	err = sqlitex.Execute(conn, `SELECT name FROM sqlite_schema
+		WHERE type = 'table' AND name NOT LIKE 'sqlite_%' AND sql NOT LIKE 'CREATE VIRTUAL%'
+		ORDER BY name;`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			tables = append(tables, stmt.ColumnText(0))
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list tables: %w", err)
+	}
+
+	counts := make(map[string]int64, len(tables))
+	var total int64
+	for _, table := range tables {
+		var n int64
+		err := sqlitex.ExecuteTransient(conn, fmt.Sprintf("SELECT count(*) FROM %s;", quoteIdentifier(table)), &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				n = stmt.ColumnInt64(0)
+				return nil
+			},
+		})
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to count rows of table %q: %w", table, err)
+		}
+		counts[table] = n
+		total += n
+	}
+	return counts, total, nil
+}
@@ -0,0 +1,133 @@
+package sqlitebackup
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// SignatureExtension is appended to the backup filename to name its
+// detached signature, see Config.SigningKeyPath.
+const SignatureExtension = ".sig"
+
+// signatureOptions selects Ed25519ph, Ed25519 over the SHA-512 digest of
+// the file, so a backup is signed and verified without reading it into
+// memory.
+var signatureOptions = &ed25519.Options{Hash: crypto.SHA512}
+
+// LoadSigningKey reads an Ed25519 private key from a PEM encoded PKCS #8
+// file, e.g. created with `openssl genpkey -algorithm ed25519`.
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %w", err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key %q is a %T, not an Ed25519 key", path, key)
+	}
+	return edKey, nil
+}
+
+// LoadSigningPublicKey reads an Ed25519 public key from a PEM encoded
+// PKIX file, e.g. created with `openssl pkey -pubout`.
+func LoadSigningPublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing public key: %w", err)
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("signing public key %q is a %T, not an Ed25519 key", path, key)
+	}
+	return edKey, nil
+}
+
+// readPEM reads the first PEM block of the file at path, which must be of
+// type blockType.
+func readPEM(path, blockType string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("key file %q has no PEM block of type %q", path, blockType)
+	}
+	return block, nil
+}
+
+// fileSHA512 returns the SHA-512 digest of the file at path.
+func fileSHA512(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %q for signing: %w", path, err)
+	}
+	defer f.Close()
+
+	hash := sha512.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return nil, fmt.Errorf("failed to hash %q: %w", path, err)
+	}
+	return hash.Sum(nil), nil
+}
+
+// signBackup writes the detached signature of the backup at backupPath
+// made with key and records the public key in the manifest. It returns
+// the path of the signature.
+func (h *Handler) signBackup(key ed25519.PrivateKey, backupPath string, manifest *Manifest) (string, error) {
+	digest, err := fileSHA512(backupPath)
+	if err != nil {
+		return "", err
+	}
+	sig, err := key.Sign(rand.Reader, digest, signatureOptions)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign backup: %w", err)
+	}
+
+	sigPath := backupPath + SignatureExtension
+	if err := h.writeFile(sigPath, []byte(base64.StdEncoding.EncodeToString(sig)+"\n")); err != nil {
+		return "", fmt.Errorf("failed to write signature: %w", err)
+	}
+	manifest.SigningPublicKey = key.Public().(ed25519.PublicKey)
+	return sigPath, nil
+}
+
+// VerifySignature checks the detached signature of the backup at
+// backupPath, <backup>.sig, with publicKey. The key must come from a
+// trusted source, not from the manifest, which an attacker able to
+// replace the backup can replace as well.
+func VerifySignature(backupPath string, publicKey ed25519.PublicKey) error {
+	data, err := os.ReadFile(backupPath + SignatureExtension)
+	if err != nil {
+		return fmt.Errorf("failed to read signature: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("failed to decode signature: %w", err)
+	}
+	digest, err := fileSHA512(backupPath)
+	if err != nil {
+		return err
+	}
+	if err := ed25519.VerifyWithOptions(publicKey, digest, sig, signatureOptions); err != nil {
+		return fmt.Errorf("invalid signature of backup %q: %w", backupPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package sqlitebackup
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caasmo/restinpieces/db"
+)
+
+// writeKeyPEM writes der as a PEM block of blockType to a new file and
+// returns its path.
+func writeKeyPEM(t *testing.T, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// generateSigningKey returns the paths of a new Ed25519 private key in
+// PKCS #8 and of its public key in PKIX.
+func generateSigningKey(t *testing.T) (string, string) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeKeyPEM(t, "PRIVATE KEY", privateDER), writeKeyPEM(t, "PUBLIC KEY", publicDER)
+}
+
+func TestVerifySignature(t *testing.T) {
+	keyPath, publicKeyPath := generateSigningKey(t)
+	_, otherPublicKeyPath := generateSigningKey(t)
+
+	tests := []struct {
+		name string
+		// tamper modifies the signed backup at path
+		tamper        func(t *testing.T, path string)
+		publicKeyPath string
+		wantErr       bool
+	}{
+		{
+			name:          "intact",
+			tamper:        func(t *testing.T, path string) {},
+			publicKeyPath: publicKeyPath,
+		},
+		{
+			name: "tampered payload",
+			tamper: func(t *testing.T, path string) {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data[len(data)/2] ^= 0x01
+				if err := os.WriteFile(path, data, 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			publicKeyPath: publicKeyPath,
+			wantErr:       true,
+		},
+		{
+			name:          "wrong key",
+			tamper:        func(t *testing.T, path string) {},
+			publicKeyPath: otherPublicKeyPath,
+			wantErr:       true,
+		},
+		{
+			name: "missing signature",
+			tamper: func(t *testing.T, path string) {
+				if err := os.Remove(path + SignatureExtension); err != nil {
+					t.Fatal(err)
+				}
+			},
+			publicKeyPath: publicKeyPath,
+			wantErr:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sourcePath := filepath.Join(dir, "app.db")
+			createTestDatabase(t, sourcePath)
+			cfg := Config{
+				SourcePath:     sourcePath,
+				BackupDir:      filepath.Join(dir, "backups"),
+				Strategy:       StrategyVacuum,
+				Compression:    CompressionGzip,
+				SigningKeyPath: keyPath,
+			}
+			if err := NewHandler(&cfg, discardLogger()).Handle(context.Background(), db.Job{}); err != nil {
+				t.Fatal(err)
+			}
+			backups, err := filepath.Glob(filepath.Join(cfg.BackupDir, "app-*-vacuum.bck.gz"))
+			if err != nil || len(backups) != 1 {
+				t.Fatalf("got backups %q, %v, want one", backups, err)
+			}
+
+			tt.tamper(t, backups[0])
+			publicKey, err := LoadSigningPublicKey(tt.publicKeyPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = VerifySignature(backups[0], publicKey)
+			if tt.wantErr && err == nil {
+				t.Error("verification succeeded")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("verification failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadSigningKeyRejectsOtherKeys(t *testing.T) {
+	_, publicKeyPath := generateSigningKey(t)
+	if _, err := LoadSigningKey(publicKeyPath); err == nil {
+		t.Error("loaded a public key as the signing key")
+	}
+	if _, err := LoadSigningKey(filepath.Join(t.TempDir(), "missing.pem")); err == nil {
+		t.Error("loaded a missing signing key")
+	}
+}
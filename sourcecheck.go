@@ -0,0 +1,192 @@
+package sqlitebackup
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+const (
+	DirtySourceIgnore     = "ignore"
+	DirtySourceWarn       = "warn"
+	DirtySourceRefuse     = "refuse"
+	DirtySourceCheckpoint = "checkpoint"
+)
+
+// walCheckpointPages is the default wal_autocheckpoint, the number of
+// pages a WAL grows to before it is checkpointed.
+const walCheckpointPages = 1000
+
+// inspectSource looks for signs that the source database was not shut down
+// cleanly, is not checkpointed or is corrupt: a hot rollback journal, a
+// WAL without its -shm index, a WAL larger than both the database and the
+// autocheckpoint size, and a failing PRAGMA quick_check. It returns a
+// description of every problem found.
+func inspectSource(sourcePath string) []string {
+	var problems []string
+
+	if info, err := os.Stat(sourcePath + "-journal"); err == nil && info.Size() > 0 {
+		problems = append(problems, fmt.Sprintf("hot journal present (%d bytes), the database needs recovery", info.Size()))
+	}
+
+	// Checked before the database is opened, which creates the index.
+	// The index is removed after the last checkpoint, a WAL left without
+	// it was left by a crash or copied alone and is replayed on open.
+	var walSize int64
+	if info, err := os.Stat(sourcePath + "-wal"); err == nil {
+		walSize = info.Size()
+	}
+	if walSize > 0 {
+		if _, err := os.Stat(sourcePath + "-shm"); os.IsNotExist(err) {
+			problems = append(problems, fmt.Sprintf("WAL present (%d bytes) without its -shm index, the database needs recovery", walSize))
+		}
+	}
+
+	conn, err := sqlite.OpenConn(sourcePath, sqlite.OpenReadOnly)
+	if err != nil {
+		return append(problems, fmt.Sprintf("failed to open source db for quick_check: %v", err))
+	}
+	defer conn.Close()
+
+	stmt, err := conn.Prepare("PRAGMA quick_check;")
+	if err != nil {
+		return append(problems, fmt.Sprintf("quick_check failed to run: %v", err))
+	}
+	result, err := sqlitex.ResultText(stmt)
+	if err != nil {
+		return append(problems, fmt.Sprintf("quick_check failed to run: %v", err))
+	}
+	if result != "ok" {
+		problems = append(problems, fmt.Sprintf("quick_check reported: %s", result))
+	}
+
+	// A WAL outgrowing the database is not checkpointed, e.g. because
+	// autocheckpoint is disabled or a reader never finishes
+	if walSize > 0 {
+		if problem := checkWALSize(conn, sourcePath, walSize); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+
+	return problems
+}
+
+// checkWALSize describes a WAL of walSize bytes that is larger than both
+// the database and walCheckpointPages pages, empty if it is not.
+func checkWALSize(conn *sqlite.Conn, sourcePath string, walSize int64) string {
+	info, err := os.Stat(sourcePath)
+	if err != nil {
+		return fmt.Sprintf("failed to stat source db: %v", err)
+	}
+	stmt, err := conn.Prepare("PRAGMA page_size;")
+	if err != nil {
+		return fmt.Sprintf("failed to read page size: %v", err)
+	}
+	pageSize, err := sqlitex.ResultInt64(stmt)
+	if err != nil {
+		return fmt.Sprintf("failed to read page size: %v", err)
+	}
+
+	if walSize <= info.Size() || walSize <= walCheckpointPages*pageSize {
+		return ""
+	}
+	return fmt.Sprintf("WAL of %d bytes is larger than the database (%d bytes) and the autocheckpoint size, it is not being checkpointed", walSize, info.Size())
+}
+
+// recoverSource opens the source read-write, which rolls back a hot
+// journal, and checkpoints and truncates the WAL.
+func recoverSource(sourcePath string) error {
+	conn, err := sqlite.OpenConn(sourcePath, sqlite.OpenReadWrite)
+	if err != nil {
+		return fmt.Errorf("failed to open source db for recovery: %w", err)
+	}
+	defer conn.Close()
+
+	if err := sqlitex.ExecuteTransient(conn, "PRAGMA wal_checkpoint(TRUNCATE);", nil); err != nil {
+		return fmt.Errorf("failed to checkpoint source db: %w", err)
+	}
+	return nil
+}
+
+// checkSource applies the DirtySourcePolicy before a backup is taken.
+func (h *Handler) checkSource(sourcePath string) error {
+	policy := h.cfg.DirtySourcePolicy
+	if policy == "" || policy == DirtySourceIgnore {
+		return nil
+	}
+
+	problems := inspectSource(sourcePath)
+	if len(problems) == 0 {
+		h.logger.Info("Source database check passed")
+		return nil
+	}
+	for _, p := range problems {
+		h.logger.Warn("Source database check detected a problem", "problem", p, "policy", policy)
+	}
+
+	switch policy {
+	case DirtySourceWarn:
+		return nil
+	case DirtySourceRefuse:
+		return fmt.Errorf("refusing to back up source database in a dirty state: %s", problems[0])
+	case DirtySourceCheckpoint:
+		if err := recoverSource(sourcePath); err != nil {
+			return err
+		}
+		if problems := inspectSource(sourcePath); len(problems) > 0 {
+			return fmt.Errorf("source database still dirty after checkpoint: %s", problems[0])
+		}
+		h.logger.Info("Source database recovered by checkpoint")
+		return nil
+	default:
+		return fmt.Errorf("unknown dirty source policy: %q", policy)
+	}
+}
+
+// checkpointAfterBackup runs PRAGMA wal_checkpoint(TRUNCATE) on the source
+// after a successful backup, reclaiming the space of a WAL that grew
+// between backups. It needs write access to the source. A failure is
+// logged, the backup itself is not affected.
+func (h *Handler) checkpointAfterBackup(ctx context.Context, sourcePath string) {
+	conn, err := sqlite.OpenConn(sourcePath, sqlite.OpenReadWrite)
+	if err != nil {
+		h.logger.Warn("Failed to open source db for checkpoint after backup", "error", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetInterrupt(ctx.Done())
+
+	// A truncating checkpoint reports 0 frames once it completed, the
+	// reclaimed space is taken from the WAL file instead
+	walSize := func() int64 {
+		info, err := os.Stat(sourcePath + "-wal")
+		if err != nil {
+			return 0
+		}
+		return info.Size()
+	}
+	before := walSize()
+
+	var busy bool
+	var logFrames int
+	err = sqlitex.ExecuteTransient(conn, "PRAGMA wal_checkpoint(TRUNCATE);", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			busy = stmt.ColumnInt(0) != 0
+			logFrames = stmt.ColumnInt(1)
+			return nil
+		},
+	})
+	switch {
+	case err != nil:
+		h.logger.Warn("Failed to checkpoint source db after backup", "error", err)
+	case logFrames < 0:
+		h.logger.Info("Source database is not in WAL mode, no checkpoint needed")
+	case busy:
+		h.logger.Warn("Checkpoint after backup could not complete, the WAL is in use", "wal_frames", logFrames)
+	default:
+		h.logger.Info("Checkpointed and truncated source WAL after backup", "reclaimed_bytes", before-walSize())
+	}
+}
@@ -0,0 +1,129 @@
+package sqlitebackup
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// openWALDatabase creates a WAL mode database at path with 512 byte pages
+// and autocheckpoint disabled. It returns a connection kept open until the
+// test ends, so the WAL is neither checkpointed nor removed on close.
+func openWALDatabase(t *testing.T, path string) *sqlite.Conn {
+	t.Helper()
+	conn, err := sqlite.OpenConn(path, sqlite.OpenCreate|sqlite.OpenReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	// The journal mode cannot change within the transaction of a script
+	for _, query := range []string{"PRAGMA page_size = 512;", "PRAGMA journal_mode = WAL;", "PRAGMA wal_autocheckpoint = 0;"} {
+		if err := sqlitex.ExecuteTransient(conn, query, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sqlitex.ExecuteScript(conn, "CREATE TABLE t (x TEXT); INSERT INTO t VALUES ('a');", nil); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// growWAL writes about 1 MB through conn, all of it to the WAL.
+func growWAL(t *testing.T, conn *sqlite.Conn) {
+	t.Helper()
+	script := `WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 1000)
+		INSERT INTO t SELECT printf('%.1000c', 'x') FROM n;`
+	if err := sqlitex.ExecuteScript(conn, script, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInspectSource(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup creates the source database at path
+		setup       func(t *testing.T, path string)
+		wantProblem string
+	}{
+		{
+			name:  "clean rollback journal database",
+			setup: createTestDatabase,
+		},
+		{
+			name: "hot journal",
+			setup: func(t *testing.T, path string) {
+				createTestDatabase(t, path)
+				if err := os.WriteFile(path+"-journal", []byte("journal"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantProblem: "hot journal present",
+		},
+		{
+			name: "open WAL database",
+			setup: func(t *testing.T, path string) {
+				openWALDatabase(t, path)
+			},
+		},
+		{
+			name: "WAL without index",
+			setup: func(t *testing.T, path string) {
+				// The files of a live database copied without the index
+				live := filepath.Join(filepath.Dir(path), "live.db")
+				openWALDatabase(t, live)
+				for _, suffix := range []string{"", "-wal"} {
+					data, err := os.ReadFile(live + suffix)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if err := os.WriteFile(path+suffix, data, 0600); err != nil {
+						t.Fatal(err)
+					}
+				}
+			},
+			wantProblem: "without its -shm index",
+		},
+		{
+			name: "WAL not checkpointed",
+			setup: func(t *testing.T, path string) {
+				growWAL(t, openWALDatabase(t, path))
+			},
+			wantProblem: "not being checkpointed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "app.db")
+			tt.setup(t, path)
+
+			problems := inspectSource(path)
+			if tt.wantProblem == "" {
+				if len(problems) > 0 {
+					t.Errorf("unexpected problems: %q", problems)
+				}
+				return
+			}
+			if !slices.ContainsFunc(problems, func(p string) bool { return strings.Contains(p, tt.wantProblem) }) {
+				t.Errorf("got problems %q, want one with %q", problems, tt.wantProblem)
+			}
+		})
+	}
+}
+
+func TestCheckSourceCheckpointRecoversWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.db")
+	growWAL(t, openWALDatabase(t, path))
+
+	h := NewHandler(&Config{DirtySourcePolicy: DirtySourceCheckpoint}, discardLogger())
+	if err := h.checkSource(path); err != nil {
+		t.Fatal(err)
+	}
+	if problems := inspectSource(path); len(problems) > 0 {
+		t.Errorf("problems left after checkpoint: %q", problems)
+	}
+}
@@ -0,0 +1,117 @@
+package sqlitebackup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Strategy creates a copy of the SQLite database at src as a new SQLite
+// database at dst. The copy is compressed, encrypted and verified like
+// the ones of the built-in strategies. dst does not exist when Backup is
+// called.
+type Strategy interface {
+	Backup(ctx context.Context, src, dst string) error
+}
+
+// StrategyFunc adapts a function to a Strategy.
+type StrategyFunc func(ctx context.Context, src, dst string) error
+
+// Backup calls f(ctx, src, dst).
+func (f StrategyFunc) Backup(ctx context.Context, src, dst string) error {
+	return f(ctx, src, dst)
+}
+
+// RegisterStrategy adds s to the strategies of the handler, selected with
+// Config.Strategy set to name. The name is part of backup filenames, it
+// must not be empty, contain a '-', '.' or path separator, or be the name
+// of a built-in strategy. Call it before the handler is registered.
+func (h *Handler) RegisterStrategy(name string, s Strategy) error {
+	if name == "" || strings.ContainsAny(name, `-./\`) {
+		return fmt.Errorf("invalid strategy name %q: it must not be empty or contain '-', '.' or path separators", name)
+	}
+	if _, ok := builtinStrategies[name]; ok {
+		return fmt.Errorf("strategy %q is built in", name)
+	}
+	if _, ok := h.strategies[name]; ok {
+		return fmt.Errorf("strategy %q is already registered", name)
+	}
+	if h.strategies == nil {
+		h.strategies = make(map[string]Strategy)
+	}
+	h.strategies[name] = s
+	return nil
+}
+
+// strategyRun holds the inputs of a strategy for a single backup and the
+// results besides the written file.
+type strategyRun struct {
+	database string
+	source   string
+	dest     string
+
+	// capturedAt is when the copy reflects the source, by default when
+	// the strategy started.
+	capturedAt time.Time
+	export     *ExportRange
+}
+
+// strategy is an entry of the strategies of a handler. validate, if not
+// nil, checks the settings of the strategy without running it.
+type strategy struct {
+	validate func(h *Handler) error
+	backup   func(ctx context.Context, h *Handler, run *strategyRun) error
+}
+
+// builtinStrategies are the strategies of every handler.
+var builtinStrategies = map[string]strategy{
+	StrategyOnline: {
+		validate: (*Handler).validateOnlineConfig,
+		backup: func(ctx context.Context, h *Handler, run *strategyRun) error {
+			var err error
+			run.capturedAt, err = h.onlineBackup(ctx, run.source, run.dest)
+			return err
+		},
+	},
+	StrategyVacuum: {
+		backup: func(ctx context.Context, h *Handler, run *strategyRun) error {
+			return h.vacuumInto(ctx, run.source, run.dest)
+		},
+	},
+	StrategyForensic: {
+		backup: func(ctx context.Context, h *Handler, run *strategyRun) error {
+			return h.forensicArchive(ctx, run.source, run.dest)
+		},
+	},
+	StrategyExport: {
+		validate: (*Handler).validateExportConfig,
+		backup: func(ctx context.Context, h *Handler, run *strategyRun) error {
+			watermark, err := h.readExportWatermark(h.exportStatePath(run.database))
+			if err != nil {
+				return err
+			}
+			run.export, err = h.exportTable(ctx, run.source, run.dest, watermark)
+			return err
+		},
+	},
+}
+
+// lookupStrategy returns the strategy named name, the default strategy
+// for an empty name.
+func (h *Handler) lookupStrategy(name string) (strategy, error) {
+	if name == "" {
+		name = DefaultStrategy
+	}
+	if s, ok := builtinStrategies[name]; ok {
+		return s, nil
+	}
+	if s, ok := h.strategies[name]; ok {
+		return strategy{
+			backup: func(ctx context.Context, h *Handler, run *strategyRun) error {
+				return s.Backup(ctx, run.source, run.dest)
+			},
+		}, nil
+	}
+	return strategy{}, fmt.Errorf("unknown backup strategy: %q", name)
+}
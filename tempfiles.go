@@ -0,0 +1,68 @@
+package sqlitebackup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// TempFilePrefix starts the name of every temporary backup file the
+// handler writes to os.TempDir(), e.g. backup-1719830000000000000.db.
+const TempFilePrefix = "backup-"
+
+// tempFilePattern matches the temporary backup files and the journal, WAL
+// and SHM files SQLite may leave next to them.
+var tempFilePattern = regexp.MustCompile(`^` + regexp.QuoteMeta(TempFilePrefix) + `[0-9]+\.db(-journal|-wal|-shm)?$`)
+
+// newTempBackupPath returns a unique path for the temporary backup.
+func newTempBackupPath() string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("%s%d.db", TempFilePrefix, time.Now().UnixNano()))
+}
+
+// CleanupStaleTempFiles removes temporary backup files in dir last
+// modified more than olderThan ago, e.g. left behind by a crashed process.
+// Only regular files matching the handler's own naming are removed, so it
+// is safe on a shared temp directory. It returns the number of removed
+// files.
+func CleanupStaleTempFiles(dir string, olderThan time.Duration) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list temp directory: %w", err)
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	removed := 0
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !tempFilePattern.MatchString(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			return removed, fmt.Errorf("failed to remove stale temp file: %w", err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// cleanupStaleTempFiles runs CleanupStaleTempFiles on os.TempDir() if
+// Config.StaleTempFileAge is set. Failures are logged, not returned.
+func (h *Handler) cleanupStaleTempFiles() {
+	if h.cfg.StaleTempFileAge.Duration <= 0 {
+		return
+	}
+
+	removed, err := CleanupStaleTempFiles(os.TempDir(), h.cfg.StaleTempFileAge.Duration)
+	if err != nil {
+		h.logger.Warn("Failed to clean up stale temp files", "dir", os.TempDir(), "removed", removed, "error", err)
+		return
+	}
+	if removed > 0 {
+		h.logger.Info("Removed stale temp files", "dir", os.TempDir(), "removed", removed)
+	}
+}
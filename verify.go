@@ -0,0 +1,405 @@
+package sqlitebackup
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"filippo.io/age"
+	"github.com/klauspost/compress/zstd"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Verifier checks a restored backup database. Implementations assert
+// application level invariants, e.g. that a settings table has one row.
+type Verifier interface {
+	Verify(ctx context.Context, conn *sqlite.Conn) error
+}
+
+// VerifierFunc adapts an ordinary function to the Verifier interface.
+type VerifierFunc func(ctx context.Context, conn *sqlite.Conn) error
+
+// Verify calls f(ctx, conn).
+func (f VerifierFunc) Verify(ctx context.Context, conn *sqlite.Conn) error {
+	return f(ctx, conn)
+}
+
+// IntegrityCheck is the built-in Verifier running PRAGMA integrity_check.
+type IntegrityCheck struct{}
+
+// Verify implements the Verifier interface.
+func (IntegrityCheck) Verify(ctx context.Context, conn *sqlite.Conn) error {
+	stmt, err := conn.Prepare("PRAGMA integrity_check;")
+	if err != nil {
+		return fmt.Errorf("failed to prepare integrity_check statement: %w", err)
+	}
+	defer stmt.Reset()
+
+	row, err := stmt.Step()
+	if err != nil {
+		return fmt.Errorf("failed to execute integrity_check: %w", err)
+	}
+	if !row {
+		return fmt.Errorf("integrity_check returned no rows")
+	}
+
+	result := stmt.ColumnText(0)
+	if result != "ok" {
+		return fmt.Errorf("integrity_check failed, result was: %s", result)
+	}
+
+	return nil
+}
+
+// ApplicationIDCheck is a Verifier failing unless PRAGMA application_id
+// of the backup is ID. It guards against backing up an unrelated database
+// through a misconfigured source path.
+type ApplicationIDCheck struct {
+	ID int32
+}
+
+// Verify implements the Verifier interface.
+func (c ApplicationIDCheck) Verify(ctx context.Context, conn *sqlite.Conn) error {
+	stmt, err := conn.Prepare("PRAGMA application_id;")
+	if err != nil {
+		return fmt.Errorf("failed to prepare application_id statement: %w", err)
+	}
+	id, err := sqlitex.ResultInt64(stmt)
+	if err != nil {
+		return fmt.Errorf("failed to read application_id: %w", err)
+	}
+	if int32(id) != c.ID {
+		return fmt.Errorf("application_id mismatch: expected %d (0x%08x), got %d (0x%08x)", c.ID, uint32(c.ID), int32(id), uint32(id))
+	}
+	return nil
+}
+
+// VerifyOptions configures VerifyBackupWithOptions.
+type VerifyOptions struct {
+	// Identities decrypt age encrypted backups.
+	Identities []age.Identity
+	// Verifiers run after the built-in integrity check, in order.
+	Verifiers []Verifier
+	// TempDir is where the backup is decompressed for verification,
+	// os.TempDir() if empty.
+	TempDir string
+	// InMemory verifies without writing to disk, see OpenOptions.
+	InMemory bool
+	// ReadWrite verifies the decompressed copy opened read-write, see
+	// OpenOptions.
+	ReadWrite bool
+	// SigningPublicKey, if set, checks the detached signature of the
+	// backup with VerifySignature before it is decompressed.
+	SigningPublicKey ed25519.PublicKey
+	// ExpectedApplicationID, if not 0, is checked with
+	// ApplicationIDCheck before the integrity check.
+	ExpectedApplicationID int32
+	// PageSampleRate, if not 0, replaces the integrity check with a spot
+	// check of the header, the freelist and this fraction, e.g. 0.01, of
+	// randomly picked pages. It is much faster on large databases but
+	// misses corruption in the pages it does not read, combine it with
+	// periodic full checks. Not supported with InMemory.
+	PageSampleRate float64
+}
+
+// VerifyBackup decompresses a backup file to a temporary database and runs
+// the built-in integrity check followed by the given verifiers, in order.
+func VerifyBackup(ctx context.Context, compressedBackupPath string, verifiers ...Verifier) error {
+	return VerifyBackupWithOptions(ctx, compressedBackupPath, VerifyOptions{Verifiers: verifiers})
+}
+
+// VerifyBackupWithOptions is VerifyBackup for encrypted backups and other
+// options.
+func VerifyBackupWithOptions(ctx context.Context, compressedBackupPath string, opts VerifyOptions) error {
+	if opts.SigningPublicKey != nil {
+		if err := VerifySignature(compressedBackupPath, opts.SigningPublicKey); err != nil {
+			return err
+		}
+	}
+	if opts.PageSampleRate < 0 || opts.PageSampleRate > 1 {
+		return fmt.Errorf("invalid page sample rate %v, expected a fraction between 0 and 1", opts.PageSampleRate)
+	}
+	if opts.PageSampleRate > 0 && opts.InMemory {
+		return fmt.Errorf("page sampling is not supported in memory")
+	}
+	expectedSize, err := manifestUncompressedSize(compressedBackupPath, opts.Identities)
+	if err != nil {
+		return err
+	}
+
+	conn, dbPath, cleanup, err := openBackup(compressedBackupPath, OpenOptions{
+		Identities: opts.Identities,
+		TempDir:    opts.TempDir,
+		InMemory:   opts.InMemory,
+		ReadWrite:  opts.ReadWrite,
+	}, expectedSize)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if opts.ExpectedApplicationID != 0 {
+		if err := (ApplicationIDCheck{ID: opts.ExpectedApplicationID}).Verify(ctx, conn); err != nil {
+			return err
+		}
+	}
+	return runVerifiers(ctx, conn, builtinCheck(dbPath, opts.PageSampleRate), opts.Verifiers)
+}
+
+// manifestUncompressedSize returns the uncompressed size recorded in the
+// manifest of a backup, 0 if it has no manifest or one predating the
+// recorded size. The decompression opening the backup compares it with
+// the byte count, see checkSize.
+func manifestUncompressedSize(backupPath string, identities []age.Identity) (int64, error) {
+	manifest, err := ReadManifest(backupPath, identities...)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return manifest.UncompressedSize, nil
+}
+
+// checkSize compares the byte count of a decompressed backup with the
+// expected uncompressed size, 0 for unknown. This catches truncation the
+// gzip CRC misses, e.g. a backup cut at a member boundary, before the
+// much slower integrity check.
+func checkSize(expected, size int64) error {
+	if expected != 0 && size != expected {
+		return fmt.Errorf("size mismatch: expected %d, got %d", expected, size)
+	}
+	return nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// verifyWritten verifies a backup just written by the handler on a fresh
+// read-only connection, independent of the connections used to create it.
+// The backup file itself is decompressed and checked, unless it is
+// encrypted: the handler only holds the recipients, so the uncompressed
+// temporary copy is checked instead.
+func (h *Handler) verifyWritten(ctx context.Context, tempBackupPath, backupPath string) error {
+	if !h.encrypted() {
+		if err := VerifyBackupWithOptions(ctx, backupPath, VerifyOptions{
+			ReadWrite:             h.cfg.VerifyReadWrite,
+			ExpectedApplicationID: h.expectedApplicationID(),
+			PageSampleRate:        h.cfg.VerifyPageSampleRate,
+		}); err != nil {
+			return fmt.Errorf("verification of backup %q failed: %w", backupPath, err)
+		}
+		h.logger.Info("Successfully verified backup", "path", backupPath)
+		return nil
+	}
+
+	// The temporary copy of a forensic backup is an uncompressed tar
+	// archive without the extension VerifyBackup dispatches on
+	if h.cfg.Strategy == StrategyForensic {
+		h.logger.Warn("Verification of encrypted forensic archives is not supported, skipping", "path", backupPath)
+		return nil
+	}
+
+	flags := sqlite.OpenReadOnly
+	if h.cfg.VerifyReadWrite {
+		// The temporary copy was already encrypted, it may change now.
+		// The files a read-write open creates next to it are removed
+		// with it.
+		flags = sqlite.OpenReadWrite
+		defer removeJournalFiles(tempBackupPath)
+	}
+	conn, err := sqlite.OpenConn(tempBackupPath, flags)
+	if err != nil {
+		return fmt.Errorf("failed to open temporary backup for verification: %w", err)
+	}
+	defer conn.Close()
+	if id := h.expectedApplicationID(); id != 0 {
+		if err := (ApplicationIDCheck{ID: id}).Verify(ctx, conn); err != nil {
+			return fmt.Errorf("verification of backup %q failed: %w", backupPath, err)
+		}
+	}
+	if err := runVerifiers(ctx, conn, builtinCheck(tempBackupPath, h.cfg.VerifyPageSampleRate), nil); err != nil {
+		return fmt.Errorf("verification of backup %q failed: %w", backupPath, err)
+	}
+	h.logger.Info("Successfully verified backup before encryption, the encrypted file was not decrypted", "path", backupPath)
+	return nil
+}
+
+// removeJournalFiles removes the rollback journal, WAL and shared memory
+// files of the database at path.
+func removeJournalFiles(path string) {
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		os.Remove(path + suffix)
+	}
+}
+
+// expectedApplicationID returns the application_id written backups are
+// checked for, 0 for none. Exports are new databases without the
+// application_id of the source.
+func (h *Handler) expectedApplicationID() int32 {
+	if h.cfg.Strategy == StrategyExport {
+		return 0
+	}
+	return h.cfg.ExpectedApplicationID
+}
+
+// builtinCheck returns the check run before the verifiers on the
+// database at dbPath, IntegrityCheck or, with a sample rate, the page
+// sample spot check.
+func builtinCheck(dbPath string, pageSampleRate float64) Verifier {
+	if pageSampleRate > 0 {
+		return pageSampleCheck{path: dbPath, rate: pageSampleRate}
+	}
+	return IntegrityCheck{}
+}
+
+// runVerifiers runs the built-in check followed by verifiers.
+func runVerifiers(ctx context.Context, conn *sqlite.Conn, check Verifier, verifiers []Verifier) error {
+	verifiers = append([]Verifier{check}, verifiers...)
+	for _, v := range verifiers {
+		if err := v.Verify(ctx, conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DecompressFile decompresses a backup file, choosing the codec by the file
+// extension. Encrypted backups are decrypted with the given identities.
+// Decryption and decompression are streamed, destPath is the only file
+// written, with mode 0600.
+func DecompressFile(sourcePath, destPath string, identities ...age.Identity) error {
+	return decompressFile(sourcePath, destPath, identities, 0)
+}
+
+// decompressFile is DecompressFile also checking the decompressed size
+// against expectedSize, see checkSize.
+func decompressFile(sourcePath, destPath string, identities []age.Identity, expectedSize int64) error {
+	reader, err := openDecompressed(sourcePath, identities)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// The plaintext of an encrypted backup is only readable by its owner
+	destFile, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create destination file for decompression: %w", err)
+	}
+	defer destFile.Close()
+
+	size, err := io.Copy(destFile, reader)
+	if err != nil {
+		return fmt.Errorf("failed to copy and decompress data: %w", err)
+	}
+	return checkSize(expectedSize, size)
+}
+
+// decompressReader reads the decompressed content of a backup file.
+type decompressReader struct {
+	io.Reader
+	closers []func() error
+}
+
+// Close releases the decoder and closes the underlying file.
+func (r *decompressReader) Close() error {
+	var firstErr error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if err := r.closers[i](); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// openDecompressed opens a backup file and returns a reader of its
+// decrypted and decompressed content, choosing the codec by the file
+// extension.
+func openDecompressed(sourcePath string, identities []age.Identity) (io.ReadCloser, error) {
+	sourceFile, err := os.Open(sourcePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open source file for decompression: %w", err)
+	}
+	r := &decompressReader{closers: []func() error{sourceFile.Close}}
+
+	plain, plainName, err := openDecrypted(sourceFile, sourcePath, identities)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	switch filepath.Ext(plainName) {
+	case BackupExtension, ArchiveExtension:
+		r.Reader = plain
+	case ".zst":
+		zstdReader, err := zstd.NewReader(plain)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("failed to create zstd reader: %w", err)
+		}
+		r.Reader = zstdReader
+		r.closers = append(r.closers, func() error { zstdReader.Close(); return nil })
+	default:
+		gzipReader, err := gzip.NewReader(plain)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+		}
+		r.Reader = gzipReader
+		r.closers = append(r.closers, gzipReader.Close)
+	}
+
+	return r, nil
+}
+
+// SelectForVerification splits backups into the ones to verify and the ones
+// to skip. For every database the newest latest backups are always
+// verified, older ones are picked at random with a probability of
+// samplePercent, so routine runs stay cheap while every backup is
+// eventually re-checked for bit-rot.
+func SelectForVerification(files []BackupFile, latest int, samplePercent float64, rng *rand.Rand) (verify, skip []BackupFile) {
+	byDatabase := make(map[string][]BackupFile)
+	var databases []string
+	for _, f := range files {
+		if _, ok := byDatabase[f.Database]; !ok {
+			databases = append(databases, f.Database)
+		}
+		byDatabase[f.Database] = append(byDatabase[f.Database], f)
+	}
+	sort.Strings(databases)
+
+	for _, database := range databases {
+		group := byDatabase[database]
+		sort.Slice(group, func(i, j int) bool {
+			return group[i].Time.After(group[j].Time)
+		})
+
+		for i, f := range group {
+			if i < latest || rng.Float64()*100 < samplePercent {
+				verify = append(verify, f)
+			} else {
+				skip = append(skip, f)
+			}
+		}
+	}
+
+	return verify, skip
+}
@@ -0,0 +1,130 @@
+package sqlitebackup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/caasmo/restinpieces/db"
+)
+
+func TestVerifyBackupChecksUncompressedSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		sizeDiff int64
+		wantErr  string
+	}{
+		{"recorded size", 0, ""},
+		{"size mismatch", 1, "size mismatch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sourcePath := filepath.Join(dir, "app.db")
+			createTestDatabase(t, sourcePath)
+			result, err := Backup(context.Background(), Options{
+				Config: Config{SourcePath: sourcePath, BackupDir: filepath.Join(dir, "backups"), Strategy: StrategyVacuum, Manifest: true},
+				Logger: discardLogger(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			manifest, err := ReadManifest(result.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			manifest.UncompressedSize += tt.sizeDiff
+			data, err := json.Marshal(manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(strings.TrimSuffix(result.Path, EncryptionExtension)+ManifestExtension, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			err = VerifyBackup(context.Background(), result.Path)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("verification failed: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyBackupReadsEveryGzipMember(t *testing.T) {
+	tests := []struct {
+		name    string
+		members int
+	}{
+		{"single member", 1},
+		{"two members", 2},
+		{"three members", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sourcePath := filepath.Join(dir, "app.db")
+			createTestDatabase(t, sourcePath)
+			cfg := Config{SourcePath: sourcePath, BackupDir: filepath.Join(dir, "backups"), Strategy: StrategyVacuum}
+			if err := NewHandler(&cfg, discardLogger()).Handle(context.Background(), db.Job{}); err != nil {
+				t.Fatal(err)
+			}
+			backups, err := filepath.Glob(filepath.Join(cfg.BackupDir, "*.bck.gz"))
+			if err != nil || len(backups) != 1 {
+				t.Fatalf("got backups %q, want one: %v", backups, err)
+			}
+			backupPath := backups[0]
+
+			plainPath := filepath.Join(dir, "plain.db")
+			if err := DecompressFile(backupPath, plainPath); err != nil {
+				t.Fatal(err)
+			}
+			plain, err := os.ReadFile(plainPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Rewrite the backup as concatenated members, like pigz or cat
+			// produce them. A reader stopping after the first member sees
+			// a truncated database.
+			var out bytes.Buffer
+			partSize := len(plain)/tt.members + 1
+			for part := range slices.Chunk(plain, partSize) {
+				gw := gzip.NewWriter(&out)
+				if _, err := gw.Write(part); err != nil {
+					t.Fatal(err)
+				}
+				if err := gw.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(backupPath, out.Bytes(), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := VerifyBackup(context.Background(), backupPath); err != nil {
+				t.Fatalf("verification failed: %v", err)
+			}
+			restoredPath := filepath.Join(dir, "restored.db")
+			if err := DecompressFile(backupPath, restoredPath); err != nil {
+				t.Fatal(err)
+			}
+			restored, err := os.ReadFile(restoredPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(restored, plain) {
+				t.Errorf("decompressed %d bytes, want %d", len(restored), len(plain))
+			}
+		})
+	}
+}